@@ -0,0 +1,132 @@
+// Package config reads the application configuration in layers: the defaults, a YAML or TOML file,
+// the environment variables and the command line flags, each overriding the ones before.
+// Every key is named by the 'env' tag of its struct field and described by 'env-description'.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// FileEnv names the config file if not given with the '--config' flag
+const FileEnv = "CONFIG_FILE"
+
+// Loader reads the configuration from the sources given on the command line. It is kept to
+// read the configuration again, e.g. after the file changed.
+type Loader struct {
+	// path of the config file, empty if there is none
+	File string
+	// values given on the command line, by key
+	Flags map[string]string
+
+	// '--print-config': print the effective configuration and exit
+	PrintConfig bool
+	// '--docs': print the documentation of all keys and exit
+	PrintDocs bool
+}
+
+// Parse reads the command line, which has a flag for every key of the configuration struct cfg,
+// e.g. '--log-level debug' for LOG_LEVEL. '--help' lists them all.
+func Parse(cfg interface{}, name string, args []string, output io.Writer) (*Loader, error) {
+	fields, err := Fields(cfg)
+	if err != nil {
+		return nil, err
+	}
+	l := &Loader{File: os.Getenv(FileEnv), Flags: map[string]string{}}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&l.File, "config", l.File, "YAML (.yml, .yaml) or TOML (.toml) config file, also set with "+FileEnv)
+	fs.BoolVar(&l.PrintConfig, "print-config", false, "Print the effective configuration with secrets masked, and exit")
+	fs.BoolVar(&l.PrintDocs, "docs", false, "Print the documentation of all configuration keys as markdown, and exit")
+	for _, f := range fields {
+		usage := f.Description + " (" + f.Key
+		if f.Default != "" {
+			usage += ", default '" + f.Default + "'"
+		}
+		fs.Var(&flagValue{key: f.Key, flags: l.Flags, bool: f.Bool()}, f.Flag(), usage+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+	}
+	return l, nil
+}
+
+// Load fills the configuration struct cfg. A key takes the value of its flag if given, else of its
+// environment variable, else from the config file, else its default. Errors name the offending key.
+func (l *Loader) Load(cfg interface{}) error {
+	fields, err := Fields(cfg)
+	if err != nil {
+		return err
+	}
+
+	var file map[string]string
+	if l.File != "" {
+		if file, err = readFile(l.File, fields); err != nil {
+			return err
+		}
+	}
+
+	var errs []string
+	for _, f := range fields {
+		value, source, ok := l.lookup(f, file)
+		if !ok {
+			continue
+		}
+		if err := parse(f.value, value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s (%s): %v", f.Key, source, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// lookup returns the value of the field along with its source
+func (l *Loader) lookup(f Field, file map[string]string) (value string, source string, ok bool) {
+	if value, ok = l.Flags[f.Key]; ok {
+		return value, "flag --" + f.Flag(), true
+	}
+	if value, ok = os.LookupEnv(f.Key); ok {
+		return value, "environment", true
+	}
+	if value, ok = file[f.Key]; ok {
+		return value, "file " + l.File, true
+	}
+	if f.HasDefault {
+		return f.Default, "default", true
+	}
+	return "", "", false
+}
+
+// flagValue records a flag given on the command line under its key
+type flagValue struct {
+	key   string
+	flags map[string]string
+	bool  bool
+}
+
+func (v *flagValue) String() string {
+	if v == nil || v.flags == nil {
+		return ""
+	}
+	return v.flags[v.key]
+}
+
+func (v *flagValue) Set(s string) error {
+	v.flags[v.key] = s
+	return nil
+}
+
+// IsBoolFlag lets boolean keys be given without value, e.g. '--tracing'
+func (v *flagValue) IsBoolFlag() bool {
+	return v.bool
+}
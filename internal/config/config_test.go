@@ -0,0 +1,348 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the keys are prefixed to not clash with the environment of the test
+type testConfig struct {
+	Server struct {
+		Host            string        `env:"TEST_HOST" env-description:"Server host" env-default:"localhost"`
+		Port            int           `env:"TEST_PORT" env-description:"Server port" env-default:"8088"`
+		ShutdownTimeout time.Duration `env:"TEST_SHUTDOWN_TIMEOUT" env-default:"15s"`
+	}
+	Log struct {
+		Level string `env:"TEST_LOG_LEVEL" env-default:"info" env-upd:""`
+	}
+	Aliases map[string]string `env:"TEST_APPLIANCE_ALIASES" env-upd:""`
+	Sinks   []string          `env:"TEST_SINKS" env-default:"mqtt"`
+	Webhook struct {
+		URLs   []string `env:"URLS" env-upd:""`
+		Secret string   `env:"SECRET"`
+	} `env-prefix:"WEBHOOK_"`
+	Ratio        float64 `env:"TEST_RATIO"`
+	ClientSecret string  `env:"TEST_CLIENT_SECRET"`
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParse(t *testing.T) {
+	var (
+		s   string
+		b   bool
+		i   int
+		u8  int8
+		d   time.Duration
+		f   float64
+		l   []string
+		n   []int
+		m   map[string]string
+		ptr *string
+	)
+	tests := []struct {
+		target interface{}
+		value  string
+		want   interface{}
+		err    string
+	}{
+		{&s, "debug", "debug", ""},
+		{&s, "", "", ""},
+		{&b, "true", true, ""},
+		{&b, "0", false, ""},
+		{&b, "yes", false, "'yes' is not a boolean"},
+		{&i, "42", 42, ""},
+		{&i, "0x10", 16, ""},
+		{&i, "4.2", 0, "'4.2' is not an integer"},
+		{&u8, "300", int8(0), "'300' is not an integer"},
+		{&d, "1m30s", 90 * time.Second, ""},
+		{&d, "90", time.Duration(0), "'90' is not a duration like 30s or 5m"},
+		{&f, "0.25", 0.25, ""},
+		{&f, "quarter", 0.0, "'quarter' is not a number"},
+		{&l, "mqtt,webhook", []string{"mqtt", "webhook"}, ""},
+		{&l, " ", []string{}, ""},
+		{&n, "1,x", []int(nil), "'x' is not an integer"},
+		{&m, "hood:SIEMENS-LC,washer:SIEMENS-WM", map[string]string{"hood": "SIEMENS-LC", "washer": "SIEMENS-WM"}, ""},
+		{&m, "", map[string]string{}, ""},
+		{&m, "hood", map[string]string(nil), "'hood' is not a 'key:value' pair"},
+		{&ptr, "x", (*string)(nil), "unsupported type *string"},
+	}
+	for _, tt := range tests {
+		v := reflect.ValueOf(tt.target).Elem()
+		v.Set(reflect.Zero(v.Type()))
+		err := parse(v, tt.value)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parse(%s, %q) error = %v, want %q", v.Type(), tt.value, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse(%s, %q) error = %v", v.Type(), tt.value, err)
+			continue
+		}
+		if got := v.Interface(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parse(%s, %q) = %#v, want %#v", v.Type(), tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	fields, err := Fields(&testConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+		err     string
+	}{
+		{
+			name:    "keys",
+			file:    "config.yml",
+			content: "test_host: 0.0.0.0\nTEST_PORT: 9000\ntest_sinks: [mqtt, webhook]\n",
+			want:    map[string]string{"TEST_HOST": "0.0.0.0", "TEST_PORT": "9000", "TEST_SINKS": "mqtt,webhook"},
+		},
+		{
+			name:    "keys nested with '_'",
+			file:    "config.yml",
+			content: "test:\n  log:\n    level: debug\nwebhook:\n  urls: [http://a, http://b]\n",
+			want:    map[string]string{"TEST_LOG_LEVEL": "debug", "WEBHOOK_URLS": "http://a,http://b"},
+		},
+		{
+			name:    "struct sections",
+			file:    "config.yml",
+			content: "server:\n  host: localhost\n  port: 8088\n  shutdown_timeout: 5s\nlog:\n  Level: warn\nclientsecret: s3cret\n",
+			want:    map[string]string{"TEST_HOST": "localhost", "TEST_PORT": "8088", "TEST_SHUTDOWN_TIMEOUT": "5s", "TEST_LOG_LEVEL": "warn", "TEST_CLIENT_SECRET": "s3cret"},
+		},
+		{
+			name:    "map",
+			file:    "config.yml",
+			content: "test_appliance_aliases:\n  washer: SIEMENS-WM\n  hood: SIEMENS-LC\n",
+			want:    map[string]string{"TEST_APPLIANCE_ALIASES": "hood:SIEMENS-LC,washer:SIEMENS-WM"},
+		},
+		{
+			name:    "map by struct field",
+			file:    "config.yml",
+			content: "aliases:\n  dryer: SIEMENS-WT\n",
+			want:    map[string]string{"TEST_APPLIANCE_ALIASES": "dryer:SIEMENS-WT"},
+		},
+		{
+			name:    "toml",
+			file:    "config.toml",
+			content: "test_ratio = 0.5\n[server]\nport = 8089\n[test_appliance_aliases]\nhood = \"SIEMENS-LC\"\n",
+			want:    map[string]string{"TEST_RATIO": "0.5", "TEST_PORT": "8089", "TEST_APPLIANCE_ALIASES": "hood:SIEMENS-LC"},
+		},
+		{
+			name:    "empty value",
+			file:    "config.yml",
+			content: "test_host:\n",
+			want:    map[string]string{"TEST_HOST": ""},
+		},
+		{
+			name:    "unknown keys",
+			file:    "config.yml",
+			content: "server:\n  hots: localhost\nport: 8088\n",
+			err:     "unknown key(s) in config file '%s': port, server_hots",
+		},
+		{
+			name:    "unsupported format",
+			file:    "config.json",
+			content: "{}",
+			err:     "config file '%s' is neither YAML (.yml, .yaml) nor TOML (.toml)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.file, tt.content)
+			got, err := readFile(path, fields)
+			if tt.err != "" {
+				if want := strings.ReplaceAll(tt.err, "%s", path); err == nil || err.Error() != want {
+					t.Errorf("error = %v, want %q", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("values = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yml", "server:\n  host: file\n  port: 9001\nlog:\n  level: debug\ntest_sinks: [webhook]\n")
+	t.Setenv(FileEnv, file)
+	t.Setenv("TEST_PORT", "9002")
+	t.Setenv("TEST_LOG_LEVEL", "warn")
+
+	var cfg testConfig
+	var out bytes.Buffer
+	l, err := Parse(&cfg, "test", []string{"--test-log-level", "error"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.File != file {
+		t.Errorf("File = %q, want %q from %s", l.File, file, FileEnv)
+	}
+	if err := l.Load(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  string
+		got  interface{}
+		want interface{}
+	}{
+		{"default", cfg.Server.ShutdownTimeout, 15 * time.Second},
+		{"file over default", cfg.Server.Host, "file"},
+		{"file list over default", cfg.Sinks, []string{"webhook"}},
+		{"environment over file", cfg.Server.Port, 9002},
+		{"flag over environment", cfg.Log.Level, "error"},
+		{"no default", cfg.Ratio, 0.0},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.key, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("TEST_PORT", "eighty")
+	var cfg testConfig
+	l := &Loader{Flags: map[string]string{"TEST_RATIO": "half"}}
+	err := l.Load(&cfg)
+	if err == nil {
+		t.Fatal("Load succeeded with invalid values")
+	}
+	for _, want := range []string{
+		"TEST_PORT (environment): 'eighty' is not an integer",
+		"TEST_RATIO (flag --test-ratio): 'half' is not a number",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not name %q", err, want)
+		}
+	}
+}
+
+func TestChangedAndCopy(t *testing.T) {
+	var before, after testConfig
+	before.Server.Port = 8088
+	before.Log.Level = "info"
+	before.Aliases = map[string]string{"hood": "SIEMENS-LC"}
+	after = before
+	after.Server.Port = 9000
+	after.Log.Level = "debug"
+	after.Aliases = map[string]string{"hood": "SIEMENS-LC"}
+	after.Webhook.URLs = []string{"http://a"}
+
+	tests := []struct {
+		name string
+		old  *testConfig
+		new  *testConfig
+		want []string
+	}{
+		{"same", &before, &before, nil},
+		{"equal maps", &before, &testConfig{Server: before.Server, Log: before.Log, Aliases: map[string]string{"hood": "SIEMENS-LC"}}, nil},
+		{"changed in order of declaration", &before, &after, []string{"TEST_PORT", "TEST_LOG_LEVEL", "WEBHOOK_URLS"}},
+	}
+	for _, tt := range tests {
+		got, err := Changed(tt.old, tt.new)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Changed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := Changed(before, after); err == nil {
+		t.Error("Changed accepted structs instead of pointers")
+	}
+
+	dst := before
+	if err := Copy(&dst, &after, []string{"TEST_LOG_LEVEL", "WEBHOOK_URLS"}); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Log.Level != "debug" || !reflect.DeepEqual(dst.Webhook.URLs, []string{"http://a"}) {
+		t.Errorf("the keys were not copied: %+v", dst)
+	}
+	if dst.Server.Port != 8088 {
+		t.Errorf("TEST_PORT copied although not listed: %d", dst.Server.Port)
+	}
+	if left, _ := Changed(&dst, &after); !reflect.DeepEqual(left, []string{"TEST_PORT"}) {
+		t.Errorf("Changed after Copy = %v, want [TEST_PORT]", left)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	var cfg testConfig
+	cfg.ClientSecret = "client-secret"
+	cfg.Webhook.Secret = "hook-secret"
+	cfg.Webhook.URLs = []string{"http://user:pw@ha:8123/api/webhook/hc", "https://token@other/hook"}
+	cfg.Server.Host = "localhost"
+
+	var out bytes.Buffer
+	if err := Print(&out, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	printed := out.String()
+	for _, secret := range []string{"client-secret", "hook-secret", "user", "pw", "token@"} {
+		if strings.Contains(printed, secret) {
+			t.Errorf("printed configuration contains %q:\n%s", secret, printed)
+		}
+	}
+	for _, want := range []string{
+		"# Server host\nTEST_HOST: \"localhost\"",
+		"TEST_CLIENT_SECRET: \"[REDACTED]\"",
+		"WEBHOOK_SECRET: \"[REDACTED]\"",
+		"WEBHOOK_URLS: \"http://ha:8123/api/webhook/hc,https://other/hook\"",
+		"TEST_RATIO: \"0\"",
+	} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("printed configuration lacks %q:\n%s", want, printed)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	var cfg testConfig
+	cfg.ClientSecret = "client-secret"
+	cfg.Webhook.Secret = "hook-secret"
+	cfg.Webhook.URLs = []string{"http://user:pw@ha:8123/api/webhook/hc"}
+	cfg.Aliases = map[string]string{"hood": "SIEMENS-LC"}
+
+	redacted := cfg
+	if err := Redact(&redacted); err != nil {
+		t.Fatal(err)
+	}
+	if redacted.ClientSecret != "[REDACTED]" || redacted.Webhook.Secret != "[REDACTED]" {
+		t.Errorf("secrets not masked: %q, %q", redacted.ClientSecret, redacted.Webhook.Secret)
+	}
+	if want := []string{"http://ha:8123/api/webhook/hc"}; !reflect.DeepEqual(redacted.Webhook.URLs, want) {
+		t.Errorf("URLs = %q, want %q", redacted.Webhook.URLs, want)
+	}
+	if !reflect.DeepEqual(redacted.Aliases, cfg.Aliases) {
+		t.Errorf("Aliases = %v, want %v", redacted.Aliases, cfg.Aliases)
+	}
+	if cfg.Webhook.URLs[0] != "http://user:pw@ha:8123/api/webhook/hc" {
+		t.Errorf("the URLs of the original configuration were changed: %q", cfg.Webhook.URLs)
+	}
+}
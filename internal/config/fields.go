@@ -0,0 +1,220 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field is a single configuration key, as named by the 'env' tag of a struct field
+type Field struct {
+	Key         string
+	Name        string
+	Description string
+	Default     string
+	HasDefault  bool
+	// the key is marked 'env-upd' and applied by a reload, others need a restart
+	Reloadable bool
+
+	// lower case names of the struct fields leading to the field, joined with '.'
+	path  string
+	value reflect.Value
+}
+
+// Flag returns the command line flag of the key, e.g. '--log-level' for LOG_LEVEL
+func (f Field) Flag() string {
+	return strings.ReplaceAll(strings.ToLower(f.Key), "_", "-")
+}
+
+// Value returns the current value of the field in the configuration syntax
+func (f Field) Value() string {
+	return format(f.value)
+}
+
+// Bool reports if the field is a boolean, given as flag without value
+func (f Field) Bool() bool {
+	return f.value.Kind() == reflect.Bool
+}
+
+// Fields returns the keys of the configuration struct pointed to by cfg, in order of declaration.
+// Struct fields without 'env' tag are walked into, prefixing their keys with 'env-prefix'.
+func Fields(cfg interface{}) ([]Field, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("configuration must be a pointer to a struct, not %T", cfg)
+	}
+	var fields []Field
+	walk(v.Elem(), "", "", &fields)
+	return fields, nil
+}
+
+func walk(v reflect.Value, prefix string, path string, fields *[]Field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		key, ok := sf.Tag.Lookup("env")
+		if !ok {
+			if sf.Type.Kind() == reflect.Struct {
+				section := path
+				if !sf.Anonymous {
+					section += fold(sf.Name) + "."
+				}
+				walk(v.Field(i), prefix+sf.Tag.Get("env-prefix"), section, fields)
+			}
+			continue
+		}
+		def, hasDef := sf.Tag.Lookup("env-default")
+		_, reloadable := sf.Tag.Lookup("env-upd")
+		*fields = append(*fields, Field{
+			Key:         prefix + key,
+			Name:        sf.Name,
+			Description: sf.Tag.Get("env-description"),
+			Default:     def,
+			HasDefault:  hasDef,
+			Reloadable:  reloadable,
+			path:        path + fold(sf.Name),
+			value:       v.Field(i),
+		})
+	}
+}
+
+// fold returns the name in lower case without '_' and '-', so 'shutdown_timeout' matches ShutdownTimeout
+func fold(name string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(name))
+}
+
+// Changed returns the keys with different values in the configurations old and new, of the same type
+func Changed(old, new interface{}) ([]string, error) {
+	before, err := Fields(old)
+	if err != nil {
+		return nil, err
+	}
+	after, err := Fields(new)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for i, f := range before {
+		if f.Value() != after[i].Value() {
+			keys = append(keys, f.Key)
+		}
+	}
+	return keys, nil
+}
+
+// Copy sets the fields with the given keys in dst to their values in src, of the same type
+func Copy(dst, src interface{}, keys []string) error {
+	to, err := Fields(dst)
+	if err != nil {
+		return err
+	}
+	from, err := Fields(src)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	for _, k := range keys {
+		set[k] = true
+	}
+	for i, f := range to {
+		if set[f.Key] {
+			f.value.Set(from[i].value)
+		}
+	}
+	return nil
+}
+
+// parse sets the value from its text, with lists separated by ',' and map entries as 'key:value'
+func parse(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a boolean", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("'%s' is not a duration like 30s or 5m", s)
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", s)
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("'%s' is not a number", s)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		if strings.TrimSpace(s) != "" {
+			for _, item := range strings.Split(s, ",") {
+				e := reflect.New(v.Type().Elem()).Elem()
+				if err := parse(e, item); err != nil {
+					return err
+				}
+				list = reflect.Append(list, e)
+			}
+		}
+		v.Set(list)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		if strings.TrimSpace(s) != "" {
+			for _, item := range strings.Split(s, ",") {
+				kv := strings.SplitN(item, ":", 2)
+				if len(kv) != 2 {
+					return fmt.Errorf("'%s' is not a 'key:value' pair", item)
+				}
+				k := reflect.New(v.Type().Key()).Elem()
+				e := reflect.New(v.Type().Elem()).Elem()
+				if err := parse(k, kv[0]); err != nil {
+					return err
+				}
+				if err := parse(e, kv[1]); err != nil {
+					return err
+				}
+				m.SetMapIndex(k, e)
+			}
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// format returns the value in the syntax read by parse
+func format(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = format(v.Index(i))
+		}
+		return strings.Join(items, ",")
+	case reflect.Map:
+		items := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			items = append(items, format(k)+":"+format(v.MapIndex(k)))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
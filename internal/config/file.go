@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// readFile reads a YAML or TOML config file into values by key. Keys are the names of the
+// environment variables in any case, nested keys are joined with '_', so 'log: {level: debug}'
+// sets LOG_LEVEL. Keys can also be nested like the configuration struct, so 'server: {port: 8088}'
+// sets the Port of Server, PORT. Lists are joined with ',', and a table sets a map key like APPLIANCE_ALIASES.
+func readFile(path string, fields []Field) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	var doc map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		_, err = toml.Decode(string(data), &doc)
+	default:
+		return nil, fmt.Errorf("config file '%s' is neither YAML (.yml, .yaml) nor TOML (.toml)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file '%s': %v", path, err)
+	}
+
+	values := map[string]string{}
+	var unknown []string
+	flatten(nil, doc, index(fields), values, &unknown)
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown key(s) in config file '%s': %s", path, strings.Join(unknown, ", "))
+	}
+	return values, nil
+}
+
+// names of the fields in the config file: the key, or the path of the struct field
+type names struct {
+	kinds map[string]reflect.Kind // by key
+	paths map[string]string       // keys by path
+}
+
+func index(fields []Field) names {
+	n := names{kinds: make(map[string]reflect.Kind, len(fields)), paths: make(map[string]string, len(fields))}
+	for _, f := range fields {
+		n.kinds[f.Key] = f.value.Kind()
+		n.paths[f.path] = f.Key
+	}
+	return n
+}
+
+// resolve returns the key named by the nested names of the file, either joined with '_' like
+// 'log: {level: debug}' for LOG_LEVEL, or following the struct fields like 'server: {port: 8088}' for PORT
+func (n names) resolve(nested []string) (key string, kind reflect.Kind, known bool) {
+	key = strings.ToUpper(strings.Join(nested, "_"))
+	if kind, known = n.kinds[key]; known {
+		return
+	}
+	folded := make([]string, len(nested))
+	for i, name := range nested {
+		folded[i] = fold(name)
+	}
+	if key, known = n.paths[strings.Join(folded, ".")]; known {
+		kind = n.kinds[key]
+	}
+	return
+}
+
+func flatten(nested []string, node interface{}, n names, values map[string]string, unknown *[]string) {
+	key, kind, known := n.resolve(nested)
+
+	switch t := node.(type) {
+	case map[string]interface{}:
+		if known && kind == reflect.Map {
+			pairs := make([]string, 0, len(t))
+			for k, v := range t {
+				pairs = append(pairs, k+":"+scalar(v))
+			}
+			sort.Strings(pairs)
+			values[key] = strings.Join(pairs, ",")
+			return
+		}
+		for k, v := range t {
+			flatten(append(nested[:len(nested):len(nested)], k), v, n, values, unknown)
+		}
+		return
+	}
+
+	if !known {
+		*unknown = append(*unknown, strings.Join(nested, "_"))
+		return
+	}
+	if list, ok := node.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, v := range list {
+			items[i] = scalar(v)
+		}
+		values[key] = strings.Join(items, ",")
+		return
+	}
+	values[key] = scalar(node)
+}
+
+func scalar(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,324 @@
+// Package eventbus distributes the parsed Home Connect server-sent events
+// in-process from the SSE subsystem to any number of subscribers.
+package eventbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// Event is the go representation of a Home Connect server-sent event
+type Event struct {
+	HaID          string    `json:"haId"`
+	Alias         string    `json:"alias,omitempty"`
+	ApplianceType string    `json:"applianceType,omitempty"`
+	Type          string    `json:"type"`
+	Data          string    `json:"data"`
+	Items         []Item    `json:"items,omitempty"`
+	Received      time.Time `json:"received"`
+}
+
+// Item is a single status, event or notify entry within the event data
+type Item struct {
+	Key          string      `json:"key"`
+	Value        interface{} `json:"value,omitempty"`
+	Unit         string      `json:"unit,omitempty"`
+	Timestamp    int64       `json:"timestamp,omitempty"`
+	Level        string      `json:"level,omitempty"`
+	Handling     string      `json:"handling,omitempty"`
+	URI          string      `json:"uri,omitempty"`
+	Name         string      `json:"name,omitempty"`
+	DisplayValue string      `json:"displayvalue,omitempty"`
+}
+
+// ParseItems decodes the items list out of the raw event data, if there is any
+func ParseItems(data string) (items []Item, err error) {
+	if strings.TrimSpace(data) == "" {
+		return
+	}
+	var payload struct {
+		Items []Item `json:"items"`
+	}
+	err = json.Unmarshal([]byte(data), &payload)
+	items = payload.Items
+	return
+}
+
+// Filter selects events by appliance and type, and reduces them to the items with matching keys
+type Filter struct {
+	HaIDs []string
+	Types []string
+	Keys  []string
+}
+
+// Match returns the event reduced to the items passing the filter, and whether anything is left to deliver
+func (f Filter) Match(ev Event) (Event, bool) {
+	if len(f.HaIDs) > 0 && !contains(f.HaIDs, ev.HaID) {
+		return ev, false
+	}
+	if len(f.Types) > 0 && !contains(f.Types, ev.Type) {
+		return ev, false
+	}
+	if len(f.Keys) == 0 {
+		return ev, true
+	}
+
+	var items []Item
+	for _, item := range ev.Items {
+		if matchKey(f.Keys, item.Key) {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return ev, false
+	}
+	ev.Items = items
+	ev.Data = filterData(ev.Data, f.Keys, items)
+	return ev, true
+}
+
+// filterData reduces the items of the raw event data to those with matching keys, keeping the
+// items and other fields as received. Falls back to the data of the matching items alone.
+func filterData(data string, keys []string, items []Item) string {
+	var payload map[string]json.RawMessage
+	var raw []json.RawMessage
+	if json.Unmarshal([]byte(data), &payload) != nil || json.Unmarshal(payload["items"], &raw) != nil {
+		fallback, _ := json.Marshal(map[string][]Item{"items": items})
+		return string(fallback)
+	}
+	var kept []json.RawMessage
+	for _, r := range raw {
+		var item struct {
+			Key string `json:"key"`
+		}
+		if json.Unmarshal(r, &item) == nil && matchKey(keys, item.Key) {
+			kept = append(kept, r)
+		}
+	}
+	payload["items"], _ = json.Marshal(kept)
+	filtered, _ := json.Marshal(payload)
+	return string(filtered)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(strings.TrimSpace(l), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchKey(patterns []string, key string) bool {
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(key, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+		if p == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy defines what happens when a subscriber does not keep up with the published events
+type Policy int
+
+const (
+	// DropOldest discards the oldest queued event to make room for the new one
+	DropOldest Policy = iota
+	// Block waits until the subscriber has room, slowing down the publisher
+	Block
+	// Disconnect closes the subscription of a subscriber whose queue is full
+	Disconnect
+)
+
+// ParsePolicy converts the configuration representation of a policy
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "", "drop-oldest":
+		return DropOldest, nil
+	case "block":
+		return Block, nil
+	case "disconnect":
+		return Disconnect, nil
+	}
+	return DropOldest, fmt.Errorf("unknown back-pressure policy '%s'", s)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "drop-oldest"
+}
+
+// Subscription is the receiving end of the bus for a single consumer
+type Subscription struct {
+	Name   string
+	Policy Policy
+
+	ch       chan Event
+	done     chan struct{}
+	inflight sync.WaitGroup
+	bus      *Bus
+	mu       sync.Mutex
+	closed   bool
+	dropped  uint64
+}
+
+// Events returns the channel the subscriber reads from. It is closed when the subscription ends.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events discarded for this subscriber
+func (s *Subscription) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close removes the subscription from the bus and closes its channel
+func (s *Subscription) Close() {
+	s.bus.remove(s)
+}
+
+func (s *Subscription) deliver(ev Event) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+
+	switch s.Policy {
+	case Block:
+		// release the lock while waiting, so the subscription can still be closed
+		s.inflight.Add(1)
+		s.mu.Unlock()
+		defer s.inflight.Done()
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		}
+		return
+
+	case Disconnect:
+		select {
+		case s.ch <- ev:
+			s.mu.Unlock()
+		default:
+			s.mu.Unlock()
+			logger.Error("Subscriber '{name}' cannot keep up with the events, disconnecting it", "name", s.Name)
+			s.Close()
+		}
+		return
+
+	default: // DropOldest
+		for {
+			select {
+			case s.ch <- ev:
+				s.mu.Unlock()
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				s.dropped++
+			default:
+			}
+		}
+	}
+}
+
+// Bus fans out every published event to all its subscribers
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// New creates an empty bus
+func New() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe registers a new consumer with a queue of the given size and back-pressure policy
+func (b *Bus) Subscribe(name string, size int, policy Policy) *Subscription {
+	if size < 1 {
+		size = 1
+	}
+	s := &Subscription{
+		Name:   name,
+		Policy: policy,
+		ch:     make(chan Event, size),
+		done:   make(chan struct{}),
+		bus:    b,
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	logger.Info("Subscriber '{name}' attached to the event bus (queue {size}, policy '{policy}')", "name", name, "size", size, "policy", policy)
+	return s
+}
+
+// Publish hands the event to every subscriber according to its policy
+func (b *Bus) Publish(ev Event) {
+	b.mu.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		s.deliver(ev)
+	}
+}
+
+// Subscribers returns the number of currently attached subscribers
+func (b *Bus) Subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+func (b *Bus) remove(s *Subscription) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	b.mu.Unlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	// blocked publishers give up once done is closed, only then it is safe to close the channel
+	s.inflight.Wait()
+	close(s.ch)
+}
+
+// Default is the bus shared by the proxy and the event sinks
+var Default = New()
+
+// Subscribe attaches a consumer to the default bus
+func Subscribe(name string, size int, policy Policy) *Subscription {
+	return Default.Subscribe(name, size, policy)
+}
+
+// Publish sends the event to all subscribers of the default bus
+func Publish(ev Event) {
+	Default.Publish(ev)
+}
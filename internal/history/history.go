@@ -0,0 +1,189 @@
+// Package history implements the event sink recording every event in an embedded
+// bbolt database, and the handler of the '/proxy/history' endpoint to query it.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+var eventsBucket = []byte("events")
+
+// interval at which the retention limits are enforced
+const pruneInterval = 10 * time.Minute
+
+// Config holds the history store settings
+type Config struct {
+	Path      string        `env:"HISTORY_PATH" env-description:"Path of the history database file" env-default:"data/history.db"`
+	Retention time.Duration `env:"HISTORY_RETENTION" env-description:"Events older than this are removed, kept forever if 0" env-default:"720h"`
+	MaxSizeMB int           `env:"HISTORY_MAX_SIZE_MB" env-description:"The oldest events are removed once the stored events exceed this size in MB, unlimited if 0" env-default:"100"`
+}
+
+// Store records the events in the bbolt database
+type Store struct {
+	cfg Config
+
+	mu         sync.Mutex
+	db         *bolt.DB
+	lastPruned time.Time
+}
+
+// New creates the history sink
+func New(cfg Config) *Store {
+	return &Store{cfg: cfg}
+}
+
+func (s *Store) Name() string {
+	return "history"
+}
+
+// Start opens, or creates, the database file
+func (s *Store) Start() error {
+	if dir := filepath.Dir(s.cfg.Path); dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+	db, err := bolt.Open(s.cfg.Path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	s.db = db
+	s.mu.Unlock()
+	logger.Info("Recording event history in '{path}'", "path", s.cfg.Path)
+	return s.prune()
+}
+
+// Deliver stores the event under its receive time
+func (s *Store) Deliver(ev eventbus.Event) error {
+	db := s.database()
+	if db == nil {
+		return errors.New("history database not open")
+	}
+	value, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(eventKey(ev.Received, seq), value)
+	})
+}
+
+// Flush enforces the retention limits, the events themselves are written as they arrive
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	due := time.Since(s.lastPruned) >= pruneInterval
+	s.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return s.prune()
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+func (s *Store) Health() error {
+	if s.database() == nil {
+		return errors.New("history database not open")
+	}
+	return nil
+}
+
+func (s *Store) database() *bolt.DB {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db
+}
+
+// Remove the events beyond the retention age, then the oldest ones until the size limit is met
+func (s *Store) prune() error {
+	db := s.database()
+	if db == nil {
+		return nil
+	}
+
+	var removed int
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+
+		if s.cfg.Retention > 0 {
+			limit := eventKey(time.Now().Add(-s.cfg.Retention), 0)
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && string(k) < string(limit); k, _ = c.Next() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+
+		if s.cfg.MaxSizeMB > 0 {
+			var size int64
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				size += int64(len(k) + len(v))
+			}
+			maxSize := int64(s.cfg.MaxSizeMB) * 1024 * 1024
+			for k, v := c.First(); k != nil && size > maxSize; k, v = c.Next() {
+				size -= int64(len(k) + len(v))
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+		return nil
+	})
+
+	s.mu.Lock()
+	s.lastPruned = time.Now()
+	s.mu.Unlock()
+	if removed > 0 {
+		logger.Info("Removed {n} event(s) from the history beyond retention", "n", removed)
+	}
+	return err
+}
+
+// Keys sort by receive time, the sequence keeps events received at the same time apart
+func eventKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	var nanos uint64
+	if t.After(time.Unix(0, 0)) {
+		// the zero time is used for open ended queries, which has no unix nanosecond representation
+		nanos = uint64(t.UnixNano())
+	}
+	binary.BigEndian.PutUint64(key[:8], nanos)
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
@@ -0,0 +1,193 @@
+package history
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultQueryLimit = 1000
+	maxQueryLimit     = 100000
+)
+
+// Query selects events out of the history
+type Query struct {
+	Filter     eventbus.Filter
+	From       time.Time
+	To         time.Time
+	Limit      int
+	Descending bool
+}
+
+// Find returns the events matching the query, oldest first unless descending
+func (s *Store) Find(q Query) (events []eventbus.Event, err error) {
+	db := s.database()
+	if db == nil {
+		return nil, errors.New("history database not open")
+	}
+	if q.To.IsZero() {
+		q.To = time.Now()
+	}
+	from := eventKey(q.From, 0)
+	to := eventKey(q.To, ^uint64(0))
+
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(eventsBucket).Cursor()
+
+		var k, v []byte
+		if q.Descending {
+			k, v = c.Seek(to)
+			if k == nil {
+				k, v = c.Last()
+			} else if string(k) > string(to) {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Seek(from)
+		}
+
+		for k != nil && len(events) < q.Limit {
+			if string(k) < string(from) || string(k) > string(to) {
+				break
+			}
+			var ev eventbus.Event
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			if ev, ok := q.Filter.Match(ev); ok {
+				events = append(events, ev)
+			}
+			if q.Descending {
+				k, v = c.Prev()
+			} else {
+				k, v = c.Next()
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// QueryHandler serves the events matching the request parameters haId, type, key, from, to, limit and order,
+// as JSON or, with format=csv, as CSV with one row per item
+func (s *Store) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := s.Find(q)
+	if err != nil {
+		logger.Error("Error querying the event history: '{err}'", "err", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" || r.Header.Get("Accept") == "text/csv" {
+		writeCSV(w, events)
+		return
+	}
+	if events == nil {
+		events = []eventbus.Event{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"events": events})
+}
+
+func parseQuery(r *http.Request) (q Query, err error) {
+	params := r.URL.Query()
+	// appliances may be given by alias too
+	haIds := splitParam(params, "haId")
+	for i := range haIds {
+		haIds[i] = proxy.ResolveAppliance(haIds[i])
+	}
+	q.Filter = eventbus.Filter{
+		HaIDs: haIds,
+		Types: splitParam(params, "type"),
+		Keys:  splitParam(params, "key"),
+	}
+
+	if q.From, err = parseTime(params.Get("from")); err != nil {
+		return
+	}
+	if q.To, err = parseTime(params.Get("to")); err != nil {
+		return
+	}
+
+	q.Limit = defaultQueryLimit
+	if l := params.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 1 || q.Limit > maxQueryLimit {
+			err = fmt.Errorf("limit must be between 1 and %d", maxQueryLimit)
+			return
+		}
+	}
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		err = errors.New("order must be 'asc' or 'desc'")
+	}
+	return
+}
+
+// Collect the values of a repeated or comma separated parameter
+func splitParam(params map[string][]string, name string) (values []string) {
+	for _, p := range params[name] {
+		for _, v := range strings.Split(p, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return
+}
+
+// Times are accepted as RFC 3339 or as unix seconds
+func parseTime(s string) (t time.Time, err error) {
+	if s == "" {
+		return
+	}
+	if secs, convErr := strconv.ParseInt(s, 10, 64); convErr == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err = time.Parse(time.RFC3339, s)
+	if err != nil {
+		err = fmt.Errorf("invalid time '%s', use RFC 3339 or unix seconds", s)
+	}
+	return
+}
+
+func writeCSV(w http.ResponseWriter, events []eventbus.Event) {
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"received", "haId", "type", "key", "value", "unit"})
+	for _, ev := range events {
+		received := ev.Received.Format(time.RFC3339Nano)
+		if len(ev.Items) == 0 {
+			cw.Write([]string{received, ev.HaID, ev.Type, "", "", ""})
+			continue
+		}
+		for _, item := range ev.Items {
+			value := ""
+			if item.Value != nil {
+				value = fmt.Sprint(item.Value)
+			}
+			cw.Write([]string{received, ev.HaID, ev.Type, item.Key, value, item.Unit})
+		}
+	}
+	cw.Flush()
+}
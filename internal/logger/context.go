@@ -0,0 +1,18 @@
+package logger
+
+import "context"
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the logger entry, for logging with request-scoped fields
+func NewContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns the logger entry of the context, or a logger without fields
+func FromContext(ctx context.Context) *Entry {
+	if e, ok := ctx.Value(contextKey{}).(*Entry); ok {
+		return e
+	}
+	return &Entry{}
+}
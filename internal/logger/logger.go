@@ -1,57 +1,287 @@
+// Package logger writes leveled log lines to stdout and the rotated log file, as text or as JSON.
+//
+// Messages keep the '{placeholder}' style: the arguments are key/value pairs, every
+// placeholder is replaced with the value of its key, and all pairs are logged as fields.
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// Level is the severity of a log line
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel reads a level name: debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) || (name == "WARN" && strings.EqualFold(s, "warning")) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s', expected debug, info, warn or error", s)
+}
+
+// Config holds the logging settings
+type Config struct {
+	Level      string `env:"LOG_LEVEL" env-upd:"" env-description:"Minimum level of logged lines: debug, info, warn or error" env-default:"info"`
+	Format     string `env:"LOG_FORMAT" env-description:"Format of the log lines: text, or json with the key/value pairs as fields" env-default:"text"`
+	File       string `env:"LOG_FILE" env-description:"Log file written along with stdout, '-' to log to stdout only" env-default:"data/app.log"`
+	MaxSize    int    `env:"LOG_MAX_SIZE_MB" env-description:"Size in megabytes at which the log file is rotated" env-default:"10"`
+	MaxAge     int    `env:"LOG_MAX_AGE_DAYS" env-description:"Days rotated log files are kept, 0 to keep them regardless of age" env-default:"30"`
+	MaxBackups int    `env:"LOG_MAX_BACKUPS" env-description:"Number of rotated log files kept, 0 to keep them all" env-default:"5"`
+	Compress   bool   `env:"LOG_COMPRESS" env-description:"Compress rotated log files with gzip" env-default:"true"`
+}
+
+// StdoutOnly is the log file name to not write a log file
+const StdoutOnly = "-"
+
 var (
-	InfoLogger  *log.Logger
-	DebugLogger *log.Logger
-	ErrorLogger *log.Logger
+	level      int32 = int32(LevelInfo)
+	jsonFormat int32
+
+	// until Init, lines go to stdout only
+	mu      sync.Mutex
+	loggers [4]*log.Logger // text lines in the log file, by level
+	file    io.WriteCloser
 )
 
-func init() {
-	logfile, err := os.OpenFile("data/app.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
+// Init applies the level and format, and opens the log file. A log file that can not be written
+// is reported and left out, so logging continues on stdout.
+func Init(cfg Config) error {
+	l, err := ParseLevel(cfg.Level)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	InfoLogger = log.New(logfile, "INFO: ", log.Ldate|log.Ltime)
-	ErrorLogger = log.New(logfile, "ERROR: ", log.Ldate|log.Ltime)
-}
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		atomic.StoreInt32(&jsonFormat, 0)
+	case "json":
+		atomic.StoreInt32(&jsonFormat, 1)
+	default:
+		return fmt.Errorf("unknown log format '%s', expected text or json", cfg.Format)
+	}
+	SetLevel(l)
 
-func format_string(format string, args ...interface{}) string {
-	args2 := make([]string, len(args))
-	for i, v := range args {
-		if i%2 == 0 {
-			args2[i] = fmt.Sprintf("{%v}", v)
+	var w io.WriteCloser
+	if cfg.File != "" && cfg.File != StdoutOnly {
+		if err = writable(cfg.File); err != nil {
+			Warn("Cannot write log file '{file}', logging to stdout only: {err}", "file", cfg.File, "err", err)
 		} else {
-			args2[i] = fmt.Sprint(v)
+			w = &lumberjack.Logger{
+				Filename:   cfg.File,
+				MaxSize:    cfg.MaxSize,
+				MaxAge:     cfg.MaxAge,
+				MaxBackups: cfg.MaxBackups,
+				Compress:   cfg.Compress,
+				LocalTime:  true,
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Close()
+	}
+	file = w
+	for l, name := range levelNames {
+		loggers[l] = nil
+		if w != nil {
+			loggers[l] = log.New(w, name+": ", log.Ldate|log.Ltime)
 		}
 	}
-	r := strings.NewReplacer(args2...)
-	return r.Replace(format)
+	return nil
+}
+
+// writable checks the log file can be created or appended to, creating its directory if needed
+func writable(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Close closes the log file, later lines go to stdout only
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if file == nil {
+		return nil
+	}
+	err := file.Close()
+	file = nil
+	loggers = [4]*log.Logger{}
+	return err
+}
+
+// SetLevel changes the minimum level of logged lines, it can be called at any time
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// GetLevel returns the minimum level of logged lines
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
 }
 
-func Error(format string, args ...interface{}) {
-	_, fn, line, _ := runtime.Caller(1)
-	// below adds caller info to the string to be logged
-	format = filepath.Base(fn) + ":" + strconv.Itoa(line) + ": " + format
-	log_msg := format_string(format, args...)
-	fmt.Println(log_msg)
-	ErrorLogger.Println(log_msg)
+// Enabled reports if lines of the level are logged
+func Enabled(l Level) bool {
+	return l >= GetLevel()
 }
 
-func Info(format string, args ...interface{}) {
-	_, fn, line, _ := runtime.Caller(1)
-	// below adds caller info to the string to be logged
-	format = filepath.Base(fn) + ":" + strconv.Itoa(line) + ": " + format
-	log_msg := format_string(format, args...)
-	fmt.Println(log_msg)
-	InfoLogger.Println(log_msg)
+// Entry is a logger carrying fields added to every line it logs, e.g. the request ID
+type Entry struct {
+	fields []interface{}
+}
+
+// With returns a logger adding the key/value pairs to every line
+func With(kv ...interface{}) *Entry {
+	return (*Entry)(nil).With(kv...)
+}
+
+// With returns a logger adding the key/value pairs to the fields of the entry
+func (e *Entry) With(kv ...interface{}) *Entry {
+	n := &Entry{}
+	if e != nil {
+		n.fields = append(n.fields, e.fields...)
+	}
+	n.fields = append(n.fields, pairs(kv)...)
+	return n
+}
+
+func (e *Entry) Debug(format string, args ...interface{}) { e.log(LevelDebug, format, args) }
+func (e *Entry) Info(format string, args ...interface{})  { e.log(LevelInfo, format, args) }
+func (e *Entry) Warn(format string, args ...interface{})  { e.log(LevelWarn, format, args) }
+func (e *Entry) Error(format string, args ...interface{}) { e.log(LevelError, format, args) }
+
+func Debug(format string, args ...interface{}) { (*Entry)(nil).log(LevelDebug, format, args) }
+func Info(format string, args ...interface{})  { (*Entry)(nil).log(LevelInfo, format, args) }
+func Warn(format string, args ...interface{})  { (*Entry)(nil).log(LevelWarn, format, args) }
+func Error(format string, args ...interface{}) { (*Entry)(nil).log(LevelError, format, args) }
+
+// pairs returns the arguments as key/value pairs. A key without value, as from an odd argument
+// count, is kept with the value '!MISSING' instead of shifting the following pairs.
+func pairs(args []interface{}) []interface{} {
+	if len(args)%2 == 0 {
+		return args
+	}
+	return append(append([]interface{}{}, args...), "!MISSING")
+}
+
+// log formats and writes the line, called by the exported functions so the caller is two frames up
+func (e *Entry) log(l Level, format string, args []interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	_, fn, line, _ := runtime.Caller(2)
+	caller := filepath.Base(fn) + ":" + strconv.Itoa(line)
+
+	kv := pairs(args)
+	if e != nil {
+		kv = append(append([]interface{}{}, e.fields...), kv...)
+	}
+	kv = redactPairs(kv)
+	msg := Redact(formatString(format, kv))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if atomic.LoadInt32(&jsonFormat) == 1 {
+		data := jsonLine(l, caller, msg, kv)
+		os.Stdout.Write(data)
+		if file != nil {
+			file.Write(data)
+		}
+		return
+	}
+	text := caller + ": " + msg + Redact(extraFields(format, kv))
+	fmt.Println(text)
+	if loggers[l] != nil {
+		loggers[l].Println(text)
+	}
+}
+
+// formatString replaces every '{key}' placeholder with the value of the key
+func formatString(format string, kv []interface{}) string {
+	replacements := make([]string, 0, len(kv))
+	for i := 0; i+1 < len(kv); i += 2 {
+		replacements = append(replacements, fmt.Sprintf("{%v}", kv[i]), fmt.Sprint(kv[i+1]))
+	}
+	return strings.NewReplacer(replacements...).Replace(format)
+}
+
+// extraFields renders the pairs without placeholder in the message as ' key=value'
+func extraFields(format string, kv []interface{}) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if strings.Contains(format, "{"+key+"}") {
+			continue
+		}
+		b.WriteString(" " + key + "=" + fmt.Sprint(kv[i+1]))
+	}
+	return b.String()
+}
+
+// jsonLine renders the line as a JSON object with the pairs as fields
+func jsonLine(l Level, caller string, msg string, kv []interface{}) []byte {
+	fields := make(map[string]interface{}, len(kv)/2+4)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := kv[i+1]
+		switch t := v.(type) {
+		case error:
+			v = Redact(t.Error())
+		case string:
+			v = Redact(t)
+		case fmt.Stringer:
+			v = Redact(t.String())
+		default:
+			if text := fmt.Sprint(v); Redact(text) != text {
+				v = Redact(text)
+			}
+		}
+		fields[fmt.Sprint(kv[i])] = v
+	}
+	fields["time"] = time.Now().Format(time.RFC3339Nano)
+	fields["level"] = strings.ToLower(l.String())
+	fields["caller"] = caller
+	fields["msg"] = msg
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{"time": fields["time"], "level": fields["level"], "caller": caller, "msg": msg})
+	}
+	return append(data, '\n')
 }
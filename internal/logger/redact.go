@@ -0,0 +1,176 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces a secret in log output
+const Redacted = "[REDACTED]"
+
+// names of secret fields, in lower case without '_' and '-'. Only specific names are listed,
+// generic ones like 'code' or 'token' are also used for harmless values.
+var secretNames = map[string]bool{
+	"accesstoken": true, "refreshtoken": true, "idtoken": true, "authorizationcode": true,
+	"clientsecret": true, "password": true, "authorization": true, "apikey": true,
+}
+
+// patterns of secrets within text, the first group is kept
+var secretPatterns = []*regexp.Regexp{
+	// Authorization header values
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`),
+	// JSON fields, e.g. the token endpoint response
+	regexp.MustCompile(`(?i)("(?:access_token|refresh_token|id_token|client_secret|password)"\s*:\s*)"[^"]*"`),
+	// URL-encoded forms and queries, e.g. the token request or the 'code' of the authorization redirect
+	regexp.MustCompile(`(?i)\b((?:access_token|refresh_token|id_token|client_secret|code|password)=)[^&\s"']+`),
+	// go structs printed with field names
+	regexp.MustCompile(`\b((?:AccessToken|RefreshToken|IdToken|ClientSecret|Password):)[^\s}]+`),
+}
+
+// maximum number of registered secret values, older ones are dropped
+const maxSecrets = 64
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// RegisterSecret adds values to be masked wherever they appear in log output, e.g. the current access
+// token. Values shorter than 8 characters are ignored, they would mask ordinary text.
+func RegisterSecret(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, v := range values {
+		if len(v) < 8 || contains(secrets, v) {
+			continue
+		}
+		secrets = append(secrets, v)
+	}
+	if len(secrets) > maxSecrets {
+		secrets = secrets[len(secrets)-maxSecrets:]
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact masks the registered secrets and anything looking like a token, secret or authorization
+// code in the text. It is applied to every log line, and should be to error texts sent to clients.
+func Redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	secretsMu.RUnlock()
+	for _, p := range secretPatterns {
+		s = p.ReplaceAllString(s, "${1}"+Redacted)
+	}
+	return s
+}
+
+// IsSecretName reports if a field or key name holds a secret, e.g. ClientSecret or CLIENT_SECRET
+func IsSecretName(name string) bool {
+	n := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+	return secretNames[n]
+}
+
+// redactPairs masks the values of secret keys, and secret fields of struct values
+func redactPairs(kv []interface{}) []interface{} {
+	out := make([]interface{}, len(kv))
+	copy(out, kv)
+	for i := 0; i+1 < len(out); i += 2 {
+		if IsSecretName(fmt.Sprint(out[i])) {
+			out[i+1] = Redacted
+			continue
+		}
+		out[i+1] = redactValue(out[i+1])
+	}
+	return out
+}
+
+// redactValue returns structs with secret fields as text with those fields masked, other values unchanged
+func redactValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return v
+	}
+	t := rv.Type()
+	secret := false
+	for i := 0; i < t.NumField(); i++ {
+		if IsSecretName(t.Field(i).Name) {
+			secret = true
+		}
+	}
+	if !secret {
+		return v
+	}
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(f.Name + ":")
+		switch {
+		case IsSecretName(f.Name):
+			b.WriteString(Redacted)
+		case f.PkgPath != "": // unexported
+			b.WriteString("?")
+		default:
+			fmt.Fprint(&b, rv.Field(i).Interface())
+		}
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// RedactFields returns the JSON form of v as generic maps and slices, with the values of secret
+// fields masked, e.g. to show the configuration
+func RedactFields(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err = json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return redactTree(generic), nil
+}
+
+func redactTree(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if IsSecretName(k) {
+				if child != nil && child != "" {
+					t[k] = Redacted
+				}
+				continue
+			}
+			t[k] = redactTree(child)
+		}
+	case []interface{}:
+		for i, child := range t {
+			t[i] = redactTree(child)
+		}
+	case string:
+		return Redact(t)
+	}
+	return v
+}
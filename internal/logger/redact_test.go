@@ -0,0 +1,157 @@
+package logger_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+)
+
+// credentials holds the secrets of the token and client data, as they would be after authorization
+type credentials struct {
+	token             proxy.Token
+	client            proxy.ClientData
+	authorizationCode string
+}
+
+// newCredentials returns credentials with values unique to the test, so secrets registered
+// by one test do not mask those of another
+func newCredentials(id string) credentials {
+	return credentials{
+		token: proxy.Token{
+			AccessToken:  "eyJ4LWVudiI6IlBSRCJ9.access-token-" + id,
+			ExpiresAt:    1700000000,
+			ExpiresIn:    86400,
+			IdToken:      "eyJ4LWVudiI6IlBSRCJ9.id-token-" + id,
+			RefreshToken: "eyJ4LWVudiI6IlBSRCJ9.refresh-token-" + id,
+			Scope:        "IdentifyAppliance Monitor",
+			TokenType:    "Bearer",
+		},
+		client: proxy.ClientData{
+			ClientId:     "CLIENT-ID-0123456789",
+			ClientSecret: "client-secret-" + id,
+			ClientScopes: "IdentifyAppliance Monitor",
+		},
+		authorizationCode: "authorization-code-" + id,
+	}
+}
+
+func (c credentials) secrets() []string {
+	return []string{c.token.AccessToken, c.token.IdToken, c.token.RefreshToken, c.client.ClientSecret, c.authorizationCode}
+}
+
+// logNamed logs the token and client data in every way the proxy could, where the secrets
+// are recognizable by their name
+func (c credentials) logNamed() {
+	token, client := c.token, c.client
+	body, _ := json.Marshal(token)
+	form := url.Values{}
+	form.Set("client_id", client.ClientId)
+	form.Set("client_secret", client.ClientSecret)
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", token.RefreshToken)
+	form.Set("code", c.authorizationCode)
+
+	logger.Info("Token {token}", "access_token", token.AccessToken)
+	logger.Info("Refreshing with {refresh_token}", "refresh_token", token.RefreshToken)
+	logger.Info("Cached token {t}", "t", token)
+	logger.Info("Cached token {t}", "t", &token)
+	logger.Info("Client {c}", "c", client)
+	logger.Error("Missing access token: " + string(body))
+	logger.Error("200 OK: {body}", "body", string(body))
+	logger.Error("Token request failed: {payload}", "payload", form.Encode())
+	logger.Error("Redirect Error: {query} {error}", "query", "code="+c.authorizationCode+"&state=x", "error", "boom")
+	logger.Info("Header {h}", "h", "Bearer "+token.AccessToken)
+	logger.Warn(fmt.Sprintf("Token: %+v", token))
+	logger.Warn(fmt.Sprintf("Client: %+v", client))
+	logger.Info("Fields only", "client_secret", client.ClientSecret)
+	logger.With("access_token", token.AccessToken).Info("With fields")
+}
+
+// logRaw logs the secrets without anything telling them apart from other text,
+// they are only masked once registered
+func (c credentials) logRaw() {
+	logger.Info(fmt.Sprintf("Token: %v", c.token))
+	logger.Info(fmt.Sprint(c.client))
+	logger.Error("Request failed: {error}", "error", fmt.Errorf("rejected %s", c.token.AccessToken))
+}
+
+func TestNoSecretsInLogOutput(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			c := newCredentials(format)
+			file := filepath.Join(t.TempDir(), "app.log")
+			if err := logger.Init(logger.Config{Level: "debug", Format: format, File: file}); err != nil {
+				t.Fatal(err)
+			}
+			defer logger.Close()
+
+			c.logNamed()
+			out := readLog(t, file)
+			assertNoSecrets(t, out, c)
+
+			// the proxy registers the tokens and the client secret as soon as it has them
+			logger.RegisterSecret(c.secrets()...)
+			c.logRaw()
+			assertNoSecrets(t, readLog(t, file), c)
+
+			// redaction must not swallow the rest of the line
+			for _, keep := range []string{c.client.ClientId, "IdentifyAppliance Monitor", "grant_type=refresh_token", "state=x"} {
+				if !strings.Contains(out, keep) {
+					t.Errorf("'%s' missing from log output:\n%s", keep, out)
+				}
+			}
+		})
+	}
+}
+
+func readLog(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func assertNoSecrets(t *testing.T, out string, c credentials) {
+	t.Helper()
+	for _, secret := range c.secrets() {
+		if strings.Contains(out, secret) {
+			t.Errorf("secret '%s' found in log output:\n%s", secret, out)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Authorization: Bearer abc.DEF-123_x+/=", "Authorization: Bearer " + logger.Redacted},
+		{`{"access_token":"abc","expires_in":86400}`, `{"access_token":` + logger.Redacted + `,"expires_in":86400}`},
+		{`{"refresh_token" : "abc", "scope":"Monitor"}`, `{"refresh_token" : ` + logger.Redacted + `, "scope":"Monitor"}`},
+		{"client_secret=abc&grant_type=refresh_token", "client_secret=" + logger.Redacted + "&grant_type=refresh_token"},
+		{"/proxy/auth/redirect?code=abc&state=1", "/proxy/auth/redirect?code=" + logger.Redacted + "&state=1"},
+		{"{AccessToken:abc ExpiresIn:60}", "{AccessToken:" + logger.Redacted + " ExpiresIn:60}"},
+		{"statuscode=500 error_code=42", "statuscode=500 error_code=42"},
+		{"nothing secret here", "nothing secret here"},
+		{`{"error":{"code":"SDK.Error.UnsupportedOption","key":"secret"}}`, `{"error":{"code":"SDK.Error.UnsupportedOption","key":"secret"}}`},
+	}
+	for _, tt := range tests {
+		if got := logger.Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterSecretIgnoresShortValues(t *testing.T) {
+	logger.RegisterSecret("abc")
+	if got := logger.Redact("abc abcdef"); got != "abc abcdef" {
+		t.Errorf("short value masked: %q", got)
+	}
+}
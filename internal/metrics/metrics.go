@@ -0,0 +1,191 @@
+// Package metrics defines the Prometheus metrics of the proxy, recorded by the
+// subsystems and exposed on '/metrics'.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Config defines if the metrics are exposed
+type Config struct {
+	Enabled bool `env:"METRICS" env-description:"Expose Prometheus metrics on '/metrics'" env-default:"true"`
+}
+
+const namespace = "hcproxy"
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests served by the proxy, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time to serve a request, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Duration of the requests to the Home Connect API, by method and status ('error' if no response).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "status"})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Access token refreshes, by result.",
+	}, []string{"result"})
+
+	streamConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "event_stream_connected",
+		Help:      "1 while the Home Connect event stream is connected.",
+	})
+
+	streamReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "event_stream_reconnects_total",
+		Help:      "Reconnects of the Home Connect event stream.",
+	})
+
+	events = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_total",
+		Help:      "Events received from Home Connect, by type and appliance.",
+	}, []string{"type", "appliance"})
+
+	statusValues = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "appliance_status_value",
+		Help:      "Last value of the numeric status items received for an appliance.",
+	}, []string{"appliance", "key"})
+
+	mqttPublishes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_publishes_total",
+		Help:      "Messages published to the MQTT broker, by result.",
+	}, []string{"result"})
+
+	sinkDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_deliveries_total",
+		Help:      "Events delivered to the sinks, by sink and result.",
+	}, []string{"sink", "result"})
+
+	sinkQueue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sink_queue_depth",
+		Help:      "Events queued for a sink.",
+	}, []string{"sink"})
+
+	// counters of the events dropped by sink, read from the sink subscription on every scrape
+	droppedMu   sync.Mutex
+	sinkDropped = map[string]prometheus.Collector{}
+)
+
+// Handler serves the metrics in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest records a request served by the proxy
+func ObserveRequest(route string, method string, status int, d time.Duration) {
+	requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	requestDuration.WithLabelValues(route, method).Observe(d.Seconds())
+}
+
+// ObserveUpstream records a request to the Home Connect API, status 0 if it got no response
+func ObserveUpstream(method string, status int, d time.Duration) {
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+	upstreamDuration.WithLabelValues(method, label).Observe(d.Seconds())
+}
+
+// TokenRefreshed records an access token refresh
+func TokenRefreshed(err error) {
+	tokenRefreshes.WithLabelValues(result(err)).Inc()
+}
+
+// StreamConnected records the Home Connect event stream getting connected or disconnected
+func StreamConnected(connected bool) {
+	if connected {
+		streamConnected.Set(1)
+		return
+	}
+	streamConnected.Set(0)
+}
+
+// StreamReconnecting records a reconnect of the Home Connect event stream
+func StreamReconnecting() {
+	streamReconnects.Inc()
+}
+
+// EventReceived records an event from Home Connect, and the values of its numeric status items
+func EventReceived(ev eventbus.Event) {
+	appliance := ev.Alias
+	if appliance == "" {
+		appliance = ev.HaID
+	}
+	events.WithLabelValues(ev.Type, appliance).Inc()
+	if ev.Type != "STATUS" {
+		return
+	}
+	for _, item := range ev.Items {
+		if v, ok := item.Value.(float64); ok {
+			statusValues.WithLabelValues(appliance, item.Key).Set(v)
+		}
+	}
+}
+
+// MQTTPublished records a message published to the MQTT broker
+func MQTTPublished(err error) {
+	mqttPublishes.WithLabelValues(result(err)).Inc()
+}
+
+// SinkDelivered records the delivery of an event to a sink, along with the depth of its queue
+func SinkDelivered(sink string, err error, queued int) {
+	sinkDeliveries.WithLabelValues(sink, result(err)).Inc()
+	sinkQueue.WithLabelValues(sink).Set(float64(queued))
+}
+
+// SinkDropped exposes the number of events dropped for a sink because its queue was full, as
+// returned by dropped. Replaces the counter of a previously started sink with the same name.
+func SinkDropped(sink string, dropped func() uint64) {
+	c := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "sink_dropped_events_total",
+		Help:        "Events dropped for a sink because its queue was full.",
+		ConstLabels: prometheus.Labels{"sink": sink},
+	}, func() float64 {
+		return float64(dropped())
+	})
+
+	droppedMu.Lock()
+	defer droppedMu.Unlock()
+	if old, ok := sinkDropped[sink]; ok {
+		prometheus.Unregister(old)
+	}
+	prometheus.MustRegister(c)
+	sinkDropped[sink] = c
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
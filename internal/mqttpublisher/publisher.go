@@ -1,44 +1,231 @@
 package mqttpublisher
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
 	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/metrics"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-//store here publisher params
-var RootTopic string
-var Server string
-var Port string
+// time to wait for the broker to acknowledge connects and publishes
+const brokerTimeout = 5 * time.Second
+
+// Config holds the MQTT broker connection parameters
+type Config struct {
+	Host  string `env:"MQTT_HOST" env-description:"MQTT Server host" env-default:"localhost"`
+	Port  string `env:"MQTT_PORT" env-description:"MQTT Server port" env-default:"1883"`
+	Topic string `env:"MQTT_TOPIC" env-upd:"" env-description:"MQTT Topic under which to publish event data" env-default:"hc-proxy"`
+}
+
+// Publisher is the event sink publishing every event to the MQTT broker
+type Publisher struct {
+	RootTopic string
+	Server    string
+	Port      string
 
-//Create the ClientOptions struct
-func InitMqttPublisher(server string, port string, rootTopic string) {
-	RootTopic = rootTopic
-	Server = server
-	Port = port
-	logger.Info("Initialized MQTT publisher for broker '{b}' and root topic '{rt}'", "b", server+":"+port, "rt", rootTopic)
+	client  mqtt.Client
+	topicMu sync.RWMutex // guards RootTopic once started
+}
+
+// New creates the publisher for the broker and root topic in the configuration
+func New(cfg Config) *Publisher {
+	p := &Publisher{
+		RootTopic: cfg.Topic,
+		Server:    cfg.Host,
+		Port:      cfg.Port,
+	}
+	logger.Info("Initialized MQTT publisher for broker '{b}' and root topic '{rt}'", "b", p.Server+":"+p.Port, "rt", p.RootTopic)
+	return p
 }
 
-func Publish(ev Event) {
+func (p *Publisher) Name() string {
+	return "mqtt"
+}
 
+// Start opens the broker connection, which is kept and re-established if lost
+func (p *Publisher) Start() error {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker("tcp://" + Server + ":" + Port)
+	opts.AddBroker("tcp://" + p.Server + ":" + p.Port)
 	opts.SetClientID("homeconnect-proxy")
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
 
 	opts.OnConnectionLost = func(c mqtt.Client, e error) {
 		logger.Error("Connection to mqtt server lost: '{error}'", "error", e.Error())
 	}
+	// subscriptions do not survive a reconnect, so they are made on every connect
+	opts.OnConnect = func(c mqtt.Client) {
+		subscribeAll(p)
+	}
 
-	topic := RootTopic + "/" + ev.EventData.Equipment + "/" + ev.EventData.Event
-	payload := ev.EventData.Data
-
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	p.client = mqtt.NewClient(opts)
+	setActive(p)
+	token := p.client.Connect()
+	if token.WaitTimeout(brokerTimeout) && token.Error() != nil {
 		logger.Error("Error in MQTT client connection: '{err}'", "err", token.Error())
+		return token.Error()
+	}
+	return nil
+}
+
+// Deliver publishes the event data under '<root topic>/<alias or haId>/<event type>'
+func (p *Publisher) Deliver(ev eventbus.Event) error {
+	appliance := ev.HaID
+	if ev.Alias != "" {
+		appliance = ev.Alias
+	}
+	topic := p.root() + "/" + appliance + "/" + ev.Type
+
+	logger.Info("Publishing event '{evnt}' for equipment '{eq}'", "evnt", ev.Type, "eq", ev.HaID)
+	return p.publish(context.Background(), topic, []byte(ev.Data))
+}
+
+// publish the payload under the full topic, waiting for the broker to take it
+func (p *Publisher) publish(ctx context.Context, topic string, payload []byte) (err error) {
+	_, span := tracing.Start(ctx, "MQTT publish", attribute.String("messaging.destination", topic))
+	defer func() { tracing.End(span, err) }()
+
+	token := p.client.Publish(topic, 0, false, payload)
+	if !token.WaitTimeout(brokerTimeout) {
+		err = errors.New("timeout publishing to '" + topic + "'")
+	} else {
+		err = token.Error()
+	}
+	metrics.MQTTPublished(err)
+	return err
+}
+
+func (p *Publisher) root() string {
+	p.topicMu.RLock()
+	defer p.topicMu.RUnlock()
+	return p.RootTopic
+}
+
+// SetRootTopic changes the root topic of the running publisher, moving the subscriptions below the new one
+func (p *Publisher) SetRootTopic(topic string) {
+	p.topicMu.Lock()
+	old := p.RootTopic
+	p.RootTopic = topic
+	p.topicMu.Unlock()
+	if old == topic || p.client == nil || !p.client.IsConnectionOpen() {
 		return
 	}
-	logger.Info("Publishing event '{evnt}' for equipment '{eq}'", "evnt", ev.EventData.Event, "eq", ev.EventData.Equipment)
-	token := client.Publish(topic, 0, false, payload)
-	token.Wait()
 
-	client.Disconnect(250)
+	mu.Lock()
+	var topics []string
+	for t := range subscriptions {
+		topics = append(topics, old+"/"+t)
+	}
+	mu.Unlock()
+	if len(topics) > 0 {
+		if token := p.client.Unsubscribe(topics...); token.WaitTimeout(brokerTimeout) && token.Error() != nil {
+			logger.Error("Error unsubscribing from {topics}: '{err}'", "topics", topics, "err", token.Error())
+		}
+	}
+	subscribeAll(p)
+	logger.Info("MQTT root topic changed from '{old}' to '{rt}'", "old", old, "rt", topic)
+}
+
+// Flush has nothing to do, events are published as they are delivered
+func (p *Publisher) Flush() error {
+	return nil
+}
+
+func (p *Publisher) Close() error {
+	setActive(nil)
+	if p.client != nil {
+		p.client.Disconnect(250)
+	}
+	return nil
+}
+
+// Health reports if the broker connection is up
+func (p *Publisher) Health() error {
+	if p.client == nil || !p.client.IsConnectionOpen() {
+		return errors.New("not connected to broker " + p.Server + ":" + p.Port)
+	}
+	return nil
+}
+
+// handler of messages received on a subscribed topic, the context carries the span of the received message
+type handler func(ctx context.Context, topic string, payload []byte)
+
+var (
+	mu            sync.Mutex
+	active        *Publisher
+	subscriptions = map[string]handler{}
+)
+
+func setActive(p *Publisher) {
+	mu.Lock()
+	defer mu.Unlock()
+	active = p
+}
+
+// Subscribe registers a handler for messages on a topic below the root topic, e.g. 'scenes/+/run'.
+// The subscription is made once the MQTT sink is connected, and renewed on every reconnect.
+func Subscribe(topic string, h func(ctx context.Context, topic string, payload []byte)) {
+	mu.Lock()
+	subscriptions[topic] = h
+	p := active
+	mu.Unlock()
+
+	if p != nil && p.client.IsConnectionOpen() {
+		subscribeAll(p)
+	}
+}
+
+func subscribeAll(p *Publisher) {
+	mu.Lock()
+	subs := make(map[string]handler, len(subscriptions))
+	for t, h := range subscriptions {
+		subs[t] = h
+	}
+	mu.Unlock()
+
+	for topic, h := range subs {
+		h := h
+		full := p.root() + "/" + topic
+		token := p.client.Subscribe(full, 0, func(c mqtt.Client, m mqtt.Message) {
+			// work continued by the handler in the background stays in the trace of the message
+			ctx, span := tracing.Start(context.Background(), "MQTT receive", attribute.String("messaging.destination", m.Topic()))
+			defer span.End()
+			h(ctx, m.Topic(), m.Payload())
+		})
+		if token.WaitTimeout(brokerTimeout) && token.Error() != nil {
+			logger.Error("Error subscribing to '{topic}': '{err}'", "topic", full, "err", token.Error())
+			continue
+		}
+		logger.Info("Subscribed to MQTT topic '{topic}'", "topic", full)
+	}
+}
+
+// PublishMessage publishes a payload under a topic below the root topic, using the MQTT sink connection
+func PublishMessage(ctx context.Context, topic string, payload []byte) error {
+	mu.Lock()
+	p := active
+	mu.Unlock()
+	if p == nil {
+		return errors.New("MQTT sink is not enabled")
+	}
+	return p.publish(ctx, p.root()+"/"+topic, payload)
+}
+
+// TopicSegments returns the segments of a received topic below the root topic
+func TopicSegments(topic string) []string {
+	mu.Lock()
+	p := active
+	mu.Unlock()
+	if p != nil {
+		topic = strings.TrimPrefix(topic, p.root()+"/")
+	}
+	return strings.Split(topic, "/")
 }
@@ -0,0 +1,66 @@
+package mqttpublisher
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// client records the published messages in place of a broker connection
+type client struct {
+	mqtt.Client
+	published map[string]string
+}
+
+func (c *client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published[topic] = string(payload.([]byte))
+	return done{}
+}
+
+// done is a completed token
+type done struct{}
+
+func (done) Wait() bool                     { return true }
+func (done) WaitTimeout(time.Duration) bool { return true }
+func (done) Done() <-chan struct{}          { ch := make(chan struct{}); close(ch); return ch }
+func (done) Error() error                   { return nil }
+
+func TestDeliverFilteredItems(t *testing.T) {
+	c := &client{published: map[string]string{}}
+	p := New(Config{Topic: "hc-proxy"})
+	p.client = c
+
+	data := `{"haId":"SIEMENS-HCS01OVN1-1234","items":[` +
+		`{"key":"BSH.Common.Status.DoorState","value":"BSH.Common.EnumType.DoorState.Open","uri":"/api/homeappliances/SIEMENS-HCS01OVN1-1234/status/BSH.Common.Status.DoorState"},` +
+		`{"key":"Cooking.Oven.Status.CurrentCavityTemperature","value":180,"unit":"°C"}]}`
+	items, err := eventbus.ParseItems(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := eventbus.Event{HaID: "SIEMENS-HCS01OVN1-1234", Alias: "oven", Type: "STATUS", Data: data, Items: items}
+
+	filter := eventbus.Filter{Keys: []string{"Cooking.Oven.*"}}
+	ev, ok := filter.Match(ev)
+	if !ok {
+		t.Fatal("event filtered out")
+	}
+	if err := p.Deliver(ev); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, ok := c.published["hc-proxy/oven/STATUS"]
+	if !ok {
+		t.Fatalf("nothing published to 'hc-proxy/oven/STATUS': %v", c.published)
+	}
+	if strings.Contains(payload, "DoorState") {
+		t.Errorf("payload contains the filtered out item: %s", payload)
+	}
+	for _, want := range []string{`"key":"Cooking.Oven.Status.CurrentCavityTemperature"`, `"unit":"°C"`, `"haId":"SIEMENS-HCS01OVN1-1234"`} {
+		if !strings.Contains(payload, want) {
+			t.Errorf("payload lacks %s: %s", want, payload)
+		}
+	}
+}
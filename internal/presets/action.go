@@ -0,0 +1,145 @@
+package presets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+)
+
+// Action is a single operation on an appliance, used by scenes, rules and schedules. It either
+// runs a preset by name, carries a preset definition inline, or is a plain request to an appliance endpoint.
+type Action struct {
+	Appliance  string   `yaml:"appliance" json:"appliance"`
+	PresetName string   `yaml:"preset" json:"preset,omitempty"`
+	Select     []string `yaml:"select" json:"select,omitempty"`
+	Preset     `yaml:",inline"`
+	Request    *RawRequest `yaml:"request" json:"request,omitempty"`
+}
+
+// RawRequest is a request to an endpoint of the appliance, e.g. DELETE 'programs/active'
+type RawRequest struct {
+	Method string      `yaml:"method" json:"method"`
+	Path   string      `yaml:"path" json:"path"`
+	Body   interface{} `yaml:"body" json:"body,omitempty"`
+}
+
+// Result is the outcome of an executed action
+type Result struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// OK reports if the action succeeded
+func (r Result) OK() bool {
+	return r.Error == "" && r.Status >= 200 && r.Status < 300
+}
+
+// Validate checks the action has an appliance and exactly one kind of operation
+func (a *Action) Validate() error {
+	if a.Appliance == "" {
+		return errors.New("no appliance given")
+	}
+	inline := a.Program != "" || a.Setting != "" || a.Command != ""
+	kinds := 0
+	for _, k := range []bool{a.PresetName != "", inline, a.Request != nil} {
+		if k {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of 'preset', 'program', 'setting', 'command' or 'request' is required")
+	}
+	switch {
+	case inline:
+		return a.Preset.Validate()
+	case a.Request != nil:
+		switch strings.ToUpper(a.Request.Method) {
+		case http.MethodGet, http.MethodPut, http.MethodDelete:
+		default:
+			return fmt.Errorf("request method must be GET, PUT or DELETE, not '%s'", a.Request.Method)
+		}
+		if a.Request.Path == "" {
+			return errors.New("request has no path")
+		}
+	}
+	return nil
+}
+
+// Describe returns a short text for logs and reports
+func (a *Action) Describe() string {
+	switch {
+	case a.PresetName != "":
+		return "preset " + a.PresetName
+	case a.Program != "":
+		return "program " + a.Program
+	case a.Setting != "":
+		return "setting " + a.Setting
+	case a.Command != "":
+		return "command " + a.Command
+	case a.Request != nil:
+		return strings.ToUpper(a.Request.Method) + " " + a.Request.Path
+	}
+	return "nothing"
+}
+
+// Execute runs the action through the proxy
+func (a *Action) Execute(ctx context.Context) (result Result) {
+	var status int
+	var body []byte
+	var err error
+
+	haId := proxy.ResolveAppliance(a.Appliance)
+	switch {
+	case a.PresetName != "":
+		status, body, err = Run(ctx, a.Appliance, a.PresetName, a.Select, a.Value)
+	case a.Request != nil:
+		req := Request{
+			Method: strings.ToUpper(a.Request.Method),
+			Path:   "/homeappliances/" + haId + "/" + strings.TrimPrefix(a.Request.Path, "/"),
+		}
+		if a.Request.Body != nil {
+			if req.Body, err = json.Marshal(a.Request.Body); err != nil {
+				return Result{Status: http.StatusBadRequest, Error: err.Error()}
+			}
+		}
+		status, body, err = req.Send(ctx)
+	default:
+		var req Request
+		if req, err = a.Preset.Build(haId, a.Select, nil); err != nil {
+			return Result{Status: http.StatusBadRequest, Error: err.Error()}
+		}
+		status, body, err = req.Send(ctx)
+	}
+
+	result.Status = status
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if json.Valid(body) {
+		result.Body = body
+	} else if len(body) > 0 && result.Error == "" {
+		result.Error = strings.TrimSpace(string(body))
+	}
+	return
+}
+
+// StartsProgram reports if the action starts a program on the appliance
+func (a *Action) StartsProgram() bool {
+	p := &a.Preset
+	switch {
+	case a.PresetName != "":
+		var ok bool
+		if p, ok = Find(a.Appliance, a.PresetName); !ok {
+			return false
+		}
+	case a.Request != nil:
+		return strings.EqualFold(a.Request.Method, http.MethodPut) && strings.Trim(a.Request.Path, "/") == "programs/active"
+	}
+	return p.Program != "" && p.Target != "selected"
+}
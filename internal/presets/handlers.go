@@ -0,0 +1,60 @@
+package presets
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Run a preset upon POST to '/proxy/presets/{appliance}/{preset}'. Named program options are
+// selected with '?options=stage2,boost', setting and command values replaced with '?value='.
+// The Home Connect response is passed on.
+func runHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	params := r.URL.Query()
+
+	var selected []string
+	for _, o := range strings.Split(params.Get("options"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			selected = append(selected, o)
+		}
+	}
+
+	var value interface{}
+	if v, ok := params["value"]; ok && len(v) > 0 {
+		value = ParseValue(v[0])
+	}
+
+	status, body, err := Run(r.Context(), vars["appliance"], vars["preset"], selected, value)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// ParseValue interprets a value given as text: JSON literals like true, 80 or "text" keep their
+// type, anything else is taken as string, e.g. an enum value
+func ParseValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err == nil {
+		return v
+	}
+	return s
+}
+
+// Serve the preset definitions upon request to '/proxy/presets'
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	defer mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	presets := current.Presets
+	if presets == nil {
+		presets = map[string]map[string]*Preset{}
+	}
+	json.NewEncoder(w).Encode(presets)
+}
@@ -0,0 +1,306 @@
+// Package presets turns named actions from the configuration, like starting the hood
+// venting program at stage 2, into Home Connect requests sent through the proxy.
+package presets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the location of the preset definitions
+type Config struct {
+	File string `env:"PRESETS_FILE" env-upd:"" env-description:"YAML or JSON file with the preset definitions, presets are disabled if the file does not exist" env-default:"data/presets.yml"`
+}
+
+// Option is a program option of a preset. Named options are only applied when requested,
+// options without name always.
+type Option struct {
+	Name  string      `yaml:"name" json:"name,omitempty"`
+	Key   string      `yaml:"key" json:"key"`
+	Value interface{} `yaml:"value" json:"value"`
+}
+
+// Preset is a single named action on an appliance: starting or selecting a program,
+// changing a setting, or sending a command
+type Preset struct {
+	Program string      `yaml:"program" json:"program,omitempty"`
+	Target  string      `yaml:"target" json:"target,omitempty"` // 'active' (start, the default) or 'selected'
+	Options []Option    `yaml:"options" json:"options,omitempty"`
+	Setting string      `yaml:"setting" json:"setting,omitempty"`
+	Command string      `yaml:"command" json:"command,omitempty"`
+	Value   interface{} `yaml:"value" json:"value,omitempty"`
+}
+
+// File is the content of the presets file: presets by appliance (alias or haId) and name
+type File struct {
+	Presets map[string]map[string]*Preset `yaml:"presets" json:"presets"`
+}
+
+var (
+	mu      sync.RWMutex
+	current File
+)
+
+// Init loads the presets file and registers the preset endpoints with the proxy
+func Init(cfg Config) error {
+	proxy.HandleFunc("/proxy/presets", listHandler, "GET")
+	proxy.HandleFunc("/proxy/presets/{appliance}/{preset}", runHandler, "POST")
+	return Load(cfg.File)
+}
+
+// Load reads and validates the presets file, replacing the current presets only if it is valid.
+// A missing file leaves no presets defined.
+func Load(path string) error {
+	f, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	current = f
+	mu.Unlock()
+	return nil
+}
+
+// Reconfigure reads and validates the presets file of the configuration, returning the function
+// replacing the current presets with it
+func Reconfigure(cfg Config) (func(), error) {
+	f, err := ReadFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		mu.Lock()
+		current = f
+		mu.Unlock()
+	}, nil
+}
+
+// ReadFile reads and validates a presets file without applying it
+func ReadFile(path string) (f File, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			logger.Info("No presets file '{path}', presets are disabled", "path", path)
+			return File{}, nil
+		}
+		return
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &f)
+	default:
+		err = yaml.Unmarshal(data, &f)
+	}
+	if err != nil {
+		err = fmt.Errorf("error parsing presets file '%s': %v", path, err)
+		return
+	}
+	if err = f.Validate(); err != nil {
+		err = fmt.Errorf("invalid presets file '%s': %v", path, err)
+		return
+	}
+
+	var count int
+	for _, presets := range f.Presets {
+		count += len(presets)
+	}
+	logger.Info("Loaded {n} preset(s) from '{path}'", "n", count, "path", path)
+	return
+}
+
+// Validate checks every preset is complete and unambiguous
+func (f File) Validate() error {
+	for appliance, presets := range f.Presets {
+		for name, p := range presets {
+			if p == nil {
+				return fmt.Errorf("preset '%s/%s' is empty", appliance, name)
+			}
+			if err := p.Validate(); err != nil {
+				return fmt.Errorf("preset '%s/%s': %v", appliance, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the preset defines a single complete action
+func (p *Preset) Validate() error {
+	kinds := 0
+	for _, k := range []string{p.Program, p.Setting, p.Command} {
+		if k != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of 'program', 'setting' or 'command' is required")
+	}
+
+	if p.Program != "" {
+		if p.Target != "" && p.Target != "active" && p.Target != "selected" {
+			return fmt.Errorf("target must be 'active' or 'selected', not '%s'", p.Target)
+		}
+		names := map[string]bool{}
+		for i, o := range p.Options {
+			if o.Key == "" {
+				return fmt.Errorf("option %d has no key", i+1)
+			}
+			if o.Value == nil {
+				return fmt.Errorf("option '%s' has no value", o.Key)
+			}
+			if o.Name != "" {
+				if names[o.Name] {
+					return fmt.Errorf("option name '%s' is used twice", o.Name)
+				}
+				names[o.Name] = true
+			}
+		}
+	} else if len(p.Options) > 0 {
+		return errors.New("options are only allowed for program presets")
+	}
+	return nil
+}
+
+// Find returns the preset of the appliance, which may be given by alias or haId
+func Find(appliance string, name string) (*Preset, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	haId := proxy.ResolveAppliance(appliance)
+	for a, presets := range current.Presets {
+		if !strings.EqualFold(a, appliance) && proxy.ResolveAppliance(a) != haId {
+			continue
+		}
+		if p, ok := presets[name]; ok {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Request is the Home Connect request a preset translates to
+type Request struct {
+	Method string
+	Path   string
+	Body   []byte
+}
+
+// Build creates the Home Connect request for the preset, applying the selected named options.
+// The value replaces the preset value of setting and command presets, if not nil.
+func (p *Preset) Build(appliance string, selected []string, value interface{}) (req Request, err error) {
+	base := "/homeappliances/" + appliance
+	req.Method = http.MethodPut
+
+	type item struct {
+		Key   string      `json:"key"`
+		Value interface{} `json:"value"`
+	}
+	var data interface{}
+
+	switch {
+	case p.Program != "":
+		options, err := p.selectOptions(selected)
+		if err != nil {
+			return req, err
+		}
+		target := p.Target
+		if target == "" {
+			target = "active"
+		}
+		req.Path = base + "/programs/" + target
+		program := struct {
+			Key     string `json:"key"`
+			Options []item `json:"options,omitempty"`
+		}{Key: p.Program}
+		for _, o := range options {
+			program.Options = append(program.Options, item{o.Key, o.Value})
+		}
+		data = program
+
+	case p.Setting != "" || p.Command != "":
+		if value == nil {
+			value = p.Value
+		}
+		key, collection := p.Setting, "settings"
+		if p.Command != "" {
+			key, collection = p.Command, "commands"
+			if value == nil {
+				// commands like BSH.Common.Command.PauseProgram take true as value
+				value = true
+			}
+		}
+		if value == nil {
+			return req, errors.New("no value given for setting '" + key + "'")
+		}
+		req.Path = base + "/" + collection + "/" + key
+		data = item{key, value}
+	}
+
+	req.Body, err = json.Marshal(map[string]interface{}{"data": data})
+	return
+}
+
+// Pick the options without name plus the requested named ones
+func (p *Preset) selectOptions(selected []string) (options []Option, err error) {
+	wanted := map[string]bool{}
+	for _, s := range selected {
+		wanted[s] = true
+	}
+	keys := map[string]string{}
+	for _, o := range p.Options {
+		if o.Name != "" && !wanted[o.Name] {
+			continue
+		}
+		delete(wanted, o.Name)
+		if other, dup := keys[o.Key]; dup {
+			return nil, fmt.Errorf("options '%s' and '%s' both set '%s'", other, o.Name, o.Key)
+		}
+		keys[o.Key] = o.Name
+		options = append(options, o)
+	}
+	if len(wanted) > 0 {
+		var unknown []string
+		for name := range wanted {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown option(s): %s", strings.Join(unknown, ", "))
+	}
+	return
+}
+
+// Run builds the request for the named preset and sends it through the proxy
+func Run(ctx context.Context, appliance string, name string, selected []string, value interface{}) (status int, body []byte, err error) {
+	p, ok := Find(appliance, name)
+	if !ok {
+		return http.StatusNotFound, nil, fmt.Errorf("no preset '%s' for appliance '%s'", name, appliance)
+	}
+	req, err := p.Build(proxy.ResolveAppliance(appliance), selected, value)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	logger.Info("Running preset '{preset}' on '{appliance}': '{method}' '{path}'", "preset", name, "appliance", appliance, "method", req.Method, "path", req.Path)
+	return req.Send(ctx)
+}
+
+// Send the request through the proxy, returning the Home Connect response
+func (req Request) Send(ctx context.Context) (status int, body []byte, err error) {
+	resp, err := proxy.Call(ctx, req.Method, req.Path, req.Body)
+	if err != nil {
+		return http.StatusBadGateway, nil, err
+	}
+	return resp.Status, resp.Body, nil
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AccessLogConfig defines where and how the requests served by the proxy are recorded
+type AccessLogConfig struct {
+	File       string `env:"ACCESS_LOG_FILE" env-description:"JSON lines file recording every request served, '-' to disable the access log" env-default:"data/requests.jsonl"`
+	Bodies     bool   `env:"ACCESS_LOG_BODIES" env-description:"Record the request and response bodies of PUT, POST and DELETE requests" env-default:"false"`
+	MaxBody    int    `env:"ACCESS_LOG_MAX_BODY" env-description:"Bytes of a body recorded at most" env-default:"4096"`
+	MaxSize    int    `env:"ACCESS_LOG_MAX_SIZE_MB" env-description:"Size in megabytes at which the access log is rotated" env-default:"10"`
+	MaxAge     int    `env:"ACCESS_LOG_MAX_AGE_DAYS" env-description:"Days rotated access logs are kept, 0 to keep them regardless of age" env-default:"30"`
+	MaxBackups int    `env:"ACCESS_LOG_MAX_BACKUPS" env-description:"Number of rotated access logs kept, 0 to keep them all" env-default:"5"`
+	Compress   bool   `env:"ACCESS_LOG_COMPRESS" env-description:"Compress rotated access logs with gzip" env-default:"true"`
+}
+
+// accessRecord is a line of the access log
+type accessRecord struct {
+	Time           time.Time   `json:"time"`
+	RequestID      string      `json:"request_id,omitempty"`
+	Client         string      `json:"client"`
+	ForwardedFor   string      `json:"forwarded_for,omitempty"`
+	UserAgent      string      `json:"user_agent,omitempty"`
+	Method         string      `json:"method"`
+	Path           string      `json:"path"`
+	Query          string      `json:"query,omitempty"`
+	Route          string      `json:"route,omitempty"`
+	HaID           string      `json:"haId,omitempty"`
+	Status         int         `json:"status"`
+	UpstreamStatus int         `json:"upstream_status,omitempty"`
+	Cache          string      `json:"cache,omitempty"`
+	LatencyMs      float64     `json:"latency_ms"`
+	Bytes          int         `json:"bytes"`
+	Error          string      `json:"error,omitempty"`
+	RequestBody    interface{} `json:"request_body,omitempty"`
+	ResponseBody   interface{} `json:"response_body,omitempty"`
+}
+
+// bytes of an error response kept for the error of the record
+const maxErrorText = 512
+
+type accessRecordKey struct{}
+
+var (
+	accessLogMu sync.Mutex
+	accessLog   io.WriteCloser
+)
+
+// openAccessLog opens the access log file, unless disabled
+func openAccessLog() {
+	cfg := config.AccessLog
+	if cfg.File == "" || cfg.File == logger.StdoutOnly {
+		return
+	}
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	accessLog = &lumberjack.Logger{
+		Filename:   cfg.File,
+		MaxSize:    cfg.MaxSize,
+		MaxAge:     cfg.MaxAge,
+		MaxBackups: cfg.MaxBackups,
+		Compress:   cfg.Compress,
+		LocalTime:  true,
+	}
+	logger.Info("Recording requests in '{file}'", "file", cfg.File)
+}
+
+// closeAccessLog closes the access log file, later requests are not recorded
+func closeAccessLog() error {
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	if accessLog == nil {
+		return nil
+	}
+	err := accessLog.Close()
+	accessLog = nil
+	return err
+}
+
+// accessWriter keeps the status, size and beginning of a response
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	body   bytes.Buffer
+	limit  int
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := w.limit - w.body.Len(); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		w.body.Write(b[:room])
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush passes on flushing, needed by the event streams
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLogger records every request as a line of the access log
+func accessLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accessLogMu.Lock()
+		enabled := accessLog != nil
+		accessLogMu.Unlock()
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cfg := config.AccessLog
+		capture := cfg.Bodies && r.Method != http.MethodGet && r.Method != http.MethodHead
+		rec := &accessRecord{
+			Time:         time.Now(),
+			Client:       r.RemoteAddr,
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			UserAgent:    r.UserAgent(),
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			Query:        logger.Redact(r.URL.RawQuery),
+		}
+		if capture && r.Body != nil {
+			payload, _ := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+			rec.RequestBody = recordedBody(payload, cfg.MaxBody)
+		}
+
+		aw := &accessWriter{ResponseWriter: w, limit: maxErrorText}
+		if capture && cfg.MaxBody > aw.limit {
+			aw.limit = cfg.MaxBody
+		}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec)))
+
+		rec.Status = aw.status
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.Bytes = aw.bytes
+		rec.LatencyMs = float64(time.Since(rec.Time).Microseconds()) / 1000
+		rec.Cache = aw.Header().Get("X-Cache")
+		if rec.Status >= 400 && rec.Error == "" {
+			rec.Error = logger.Redact(strings.TrimSpace(string(truncate(aw.body.Bytes(), maxErrorText))))
+		}
+		if capture {
+			rec.ResponseBody = recordedBody(aw.body.Bytes(), cfg.MaxBody)
+		}
+		writeAccessRecord(rec)
+	})
+}
+
+// accessRecordFrom returns the access log record of the request, nil if requests are not recorded
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	rec, _ := ctx.Value(accessRecordKey{}).(*accessRecord)
+	return rec
+}
+
+// noteUpstream adds the outcome of the Home Connect request to the access log record
+func noteUpstream(r *http.Request, resp *http.Response, err error) {
+	rec := accessRecordFrom(r.Context())
+	if rec == nil {
+		return
+	}
+	if err != nil {
+		rec.Error = logger.Redact(err.Error())
+		return
+	}
+	rec.UpstreamStatus = resp.StatusCode
+}
+
+// recordedBody returns a body as JSON if it is, as text otherwise, with secrets masked
+func recordedBody(b []byte, limit int) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) <= limit && json.Valid(b) {
+		return json.RawMessage(logger.Redact(string(b)))
+	}
+	return logger.Redact(string(truncate(b, limit)))
+}
+
+func truncate(b []byte, limit int) []byte {
+	if len(b) > limit {
+		return b[:limit]
+	}
+	return b
+}
+
+func writeAccessRecord(rec *accessRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logger.Error("Error encoding access log record: {err}", "err", err)
+		return
+	}
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	if accessLog == nil {
+		return
+	}
+	if _, err = accessLog.Write(append(data, '\n')); err != nil {
+		logger.Error("Error writing access log: {err}", "err", err)
+	}
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AliasConfig holds the friendly appliance names
+type AliasConfig struct {
+	Aliases map[string]string `env:"APPLIANCE_ALIASES" env-upd:"" env-description:"Comma separated 'alias:haId' pairs, e.g. 'hood:SIEMENS-LC...,washer:SIEMENS-WM...'"`
+	Auto    bool              `env:"APPLIANCE_ALIASES_AUTO" env-upd:"" env-description:"Generate aliases from the name, or else the type, of appliances without configured alias" env-default:"false"`
+}
+
+var (
+	aliasesMu    sync.RWMutex
+	aliasToHaId  = map[string]string{}
+	haIdToAlias  = map[string]string{}
+	aliasInvalid = regexp.MustCompile(`[^a-z0-9_-]+`)
+)
+
+// Rebuild the alias tables out of the configuration and the known appliances
+func buildAliases() {
+	aliasesMu.RLock()
+	cfg := config.Aliases
+	aliasesMu.RUnlock()
+
+	toHaId := map[string]string{}
+	toAlias := map[string]string{}
+	for alias, haId := range cfg.Aliases {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		haId = strings.TrimSpace(haId)
+		toHaId[alias] = haId
+		toAlias[haId] = alias
+	}
+
+	if cfg.Auto {
+		// sorted by haId, so generated aliases are stable between reloads
+		list := Appliances()
+		haIds := make([]string, 0, len(list))
+		for haId := range list {
+			haIds = append(haIds, haId)
+		}
+		sort.Strings(haIds)
+
+		for _, haId := range haIds {
+			if _, ok := toAlias[haId]; ok {
+				continue
+			}
+			a := list[haId]
+			for _, candidate := range []string{a.Name, a.Type} {
+				alias := aliasInvalid.ReplaceAllString(strings.ToLower(strings.TrimSpace(candidate)), "-")
+				alias = strings.Trim(alias, "-")
+				if alias == "" {
+					continue
+				}
+				if _, taken := toHaId[alias]; taken {
+					// e.g. two ovens, number the second one
+					for i := 2; ; i++ {
+						numbered := alias + "-" + strconv.Itoa(i)
+						if _, taken := toHaId[numbered]; !taken {
+							alias = numbered
+							break
+						}
+					}
+				}
+				toHaId[alias] = haId
+				toAlias[haId] = alias
+				break
+			}
+		}
+	}
+
+	aliasesMu.Lock()
+	aliasToHaId = toHaId
+	haIdToAlias = toAlias
+	aliasesMu.Unlock()
+}
+
+// ResolveAppliance returns the haId for an alias. Anything which is not an alias is returned unchanged.
+func ResolveAppliance(nameOrHaId string) string {
+	aliasesMu.RLock()
+	defer aliasesMu.RUnlock()
+	if haId, ok := aliasToHaId[strings.ToLower(nameOrHaId)]; ok {
+		return haId
+	}
+	return nameOrHaId
+}
+
+// Alias returns the alias of the appliance, empty if it has none
+func Alias(haId string) string {
+	aliasesMu.RLock()
+	defer aliasesMu.RUnlock()
+	return haIdToAlias[haId]
+}
+
+// Replace an alias in the appliance segment of the request path with the haId, before the request is routed
+func aliasRewriter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(r.URL.Path, "/", 4)
+		// ["", "homeappliances", "<appliance>", ...] or ["", "proxy", "state", "<appliance>"]
+		switch {
+		case len(parts) >= 3 && parts[1] == "homeappliances" && parts[2] != "events":
+			parts[2] = ResolveAppliance(parts[2])
+		case len(parts) == 4 && parts[1] == "proxy" && parts[2] == "state":
+			parts[3] = ResolveAppliance(parts[3])
+		}
+		r.URL.Path = strings.Join(parts, "/")
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Add the alias to the appliance list and single appliance responses, as extra 'alias' field
+func decorateAliases(path string, body []byte) []byte {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] != "homeappliances" || len(parts) > 2 {
+		return body
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body
+	}
+	data, ok := doc["data"].(map[string]interface{})
+	if !ok {
+		return body
+	}
+
+	if len(parts) == 2 {
+		addAlias(data)
+	} else if list, ok := data["homeappliances"].([]interface{}); ok {
+		for _, a := range list {
+			if appliance, ok := a.(map[string]interface{}); ok {
+				addAlias(appliance)
+			}
+		}
+	}
+
+	decorated, err := json.Marshal(doc)
+	if err != nil {
+		return body
+	}
+	return decorated
+}
+
+func addAlias(appliance map[string]interface{}) {
+	haId, _ := appliance["haId"].(string)
+	if alias := Alias(haId); alias != "" {
+		appliance["alias"] = alias
+	}
+}
+
+// Decorate a successful response body with the aliases
+func withAliases(path string, resp *http.Response) *http.Response {
+	if resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		body = decorateAliases(path, body)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.Header.Del("Content-Length")
+	return resp
+}
+
+// Serve the alias table upon request to '/proxy/aliases'
+func aliasesHandler(w http.ResponseWriter, r *http.Request) {
+	aliasesMu.RLock()
+	list := make(map[string]string, len(aliasToHaId))
+	for alias, haId := range aliasToHaId {
+		list[alias] = haId
+	}
+	aliasesMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// Appliance is an appliance paired with the Home Connect account, as listed by '/homeappliances'
+type Appliance struct {
+	HaID      string `json:"haId"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Brand     string `json:"brand"`
+	VIB       string `json:"vib"`
+	ENumber   string `json:"enumber"`
+	Connected bool   `json:"connected"`
+}
+
+// event types after which the list of appliances is reloaded
+var applianceListEvents = map[string]bool{
+	"PAIRED":   true,
+	"DEPAIRED": true,
+}
+
+// minimum time between reloads caused by events of unknown appliances
+const applianceReloadInterval = time.Minute
+
+var (
+	appliancesMu     sync.RWMutex
+	appliances       = map[string]Appliance{}
+	appliancesLoaded time.Time
+
+	// set while the list is reloaded in the background
+	appliancesReloading int32
+)
+
+// Appliances returns the known appliances by haId
+func Appliances() map[string]Appliance {
+	appliancesMu.RLock()
+	defer appliancesMu.RUnlock()
+	list := make(map[string]Appliance, len(appliances))
+	for haId, a := range appliances {
+		list[haId] = a
+	}
+	return list
+}
+
+// Reload the list of appliances from Home Connect
+func loadAppliances() (err error) {
+	var resp struct {
+		Data struct {
+			HomeAppliances []Appliance `json:"homeappliances"`
+		} `json:"data"`
+	}
+	if err = fetchJSON("/homeappliances", &resp); err != nil {
+		logger.Error("Error loading the list of appliances: '{err}'", "err", err.Error())
+		return
+	}
+
+	list := make(map[string]Appliance, len(resp.Data.HomeAppliances))
+	for _, a := range resp.Data.HomeAppliances {
+		list[a.HaID] = a
+	}
+	appliancesMu.Lock()
+	appliances = list
+	appliancesLoaded = time.Now()
+	appliancesMu.Unlock()
+	buildAliases()
+	logger.Info("Loaded {n} appliance(s) from Home Connect", "n", len(list))
+	return
+}
+
+// Add the appliance details known so far to the event. When the appliance list changed it is reloaded
+// in the background, so the event stream is not held up; the events until then go without the details.
+func enrichEvent(ev *eventbus.Event) {
+	appliancesMu.RLock()
+	a, known := appliances[ev.HaID]
+	stale := time.Since(appliancesLoaded) > applianceReloadInterval
+	appliancesMu.RUnlock()
+
+	if (!known && stale) || applianceListEvents[ev.Type] {
+		reloadAppliances()
+	}
+	ev.ApplianceType = a.Type
+	ev.Alias = Alias(ev.HaID)
+}
+
+// Reload the list of appliances in the background, unless a reload is in progress
+func reloadAppliances() {
+	if !atomic.CompareAndSwapInt32(&appliancesReloading, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&appliancesReloading, 0)
+		loadAppliances()
+	}()
+}
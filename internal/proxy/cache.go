@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// CacheConfig holds the response cache settings
+type CacheConfig struct {
+	Enabled    bool                     `env:"CACHE" env-description:"Cache the responses of rarely changing GET endpoints" env-default:"false"`
+	TTLs       map[string]time.Duration `env:"CACHE_TTLS" env-description:"Comma separated 'route:ttl' pairs, '*' in a route matches a single path segment" env-default:"/homeappliances:1h,/homeappliances/*:1h,/homeappliances/*/programs/available:1h,/homeappliances/*/programs/available/*:24h"`
+	MaxEntries int                      `env:"CACHE_MAX_ENTRIES" env-description:"Maximum number of cached responses" env-default:"1000"`
+}
+
+// cached Home Connect response
+type cacheEntry struct {
+	path        string
+	status      int
+	contentType string
+	body        []byte
+	stored      time.Time
+	expires     time.Time
+}
+
+var (
+	cacheMu      sync.Mutex
+	cacheEntries = map[string]*cacheEntry{}
+	cacheHits    uint64
+	cacheMisses  uint64
+
+	// the TTLs ordered by route, set by Configure
+	cacheRoutes []routeDuration
+)
+
+// routeDuration is a duration configured for the paths matching a route pattern
+type routeDuration struct {
+	route    string
+	duration time.Duration
+}
+
+// Order the configured routes so the most specific comes first: the one with fewer '*' segments,
+// then the longer one. Ties are ordered by name, so the same route always wins.
+func orderRoutes(routes map[string]time.Duration) []routeDuration {
+	list := make([]routeDuration, 0, len(routes))
+	for route, d := range routes {
+		list = append(list, routeDuration{route, d})
+	}
+	sort.Slice(list, func(a, b int) bool {
+		ra, rb := list[a].route, list[b].route
+		if wa, wb := strings.Count(ra, "*"), strings.Count(rb, "*"); wa != wb {
+			return wa < wb
+		}
+		if len(ra) != len(rb) {
+			return len(ra) > len(rb)
+		}
+		return ra < rb
+	})
+	return list
+}
+
+// Duration of the first route matching the path
+func matchRoute(routes []routeDuration, p string) (time.Duration, bool) {
+	for _, r := range routes {
+		if ok, _ := path.Match(r.route, p); ok {
+			return r.duration, true
+		}
+	}
+	return 0, false
+}
+
+// Time to live of the responses of the path, zero if the path is not cached
+func cacheTTL(p string) time.Duration {
+	ttl, _ := matchRoute(cacheRoutes, p)
+	return ttl
+}
+
+// Responses differ by path, query and language
+func cacheKey(r *http.Request) string {
+	return r.URL.Path + "?" + r.URL.RawQuery + "#" + r.Header.Get("Accept-Language")
+}
+
+// Look the request up in the cache. Returns the entry if there is a fresh one, and whether
+// the response to the request may be cached.
+func cacheLookup(r *http.Request) (entry *cacheEntry, cacheable bool) {
+	if !config.Cache.Enabled || r.Method != http.MethodGet || cacheTTL(r.URL.Path) <= 0 {
+		return
+	}
+	cacheable = true
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	e, ok := cacheEntries[cacheKey(r)]
+	if !ok || time.Now().After(e.expires) {
+		cacheMisses++
+		return
+	}
+	cacheHits++
+	entry = e
+	return
+}
+
+// Store a successful response in the cache, returning it with the body still readable
+func cacheStore(r *http.Request, resp *http.Response) *http.Response {
+	ttl := cacheTTL(r.URL.Path)
+	resp.Header.Set("X-Cache", "MISS")
+	resp.Header.Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl.Seconds())))
+	if resp.StatusCode != http.StatusOK {
+		return resp
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return resp
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		path:        r.URL.Path,
+		status:      resp.StatusCode,
+		contentType: resp.Header.Get("Content-Type"),
+		body:        body,
+		stored:      now,
+		expires:     now.Add(ttl),
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if len(cacheEntries) >= config.Cache.MaxEntries {
+		evictOldest()
+	}
+	cacheEntries[cacheKey(r)] = entry
+	return resp
+}
+
+// Remove the entry closest to expiry to make room for a new one
+func evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for k, e := range cacheEntries {
+		if oldestKey == "" || e.expires.Before(oldest) {
+			oldestKey, oldest = k, e.expires
+		}
+	}
+	delete(cacheEntries, oldestKey)
+}
+
+func renderCached(w http.ResponseWriter, e *cacheEntry) {
+	remaining := int(time.Until(e.expires).Seconds())
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(remaining))
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	w.WriteHeader(e.status)
+	w.Write(decorateAliases(e.path, e.body))
+}
+
+// Remove all entries whose path matches, returns the number removed
+func cachePurge(match func(p string) bool) (removed int) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	for k, e := range cacheEntries {
+		if match(e.path) {
+			delete(cacheEntries, k)
+			removed++
+		}
+	}
+	return
+}
+
+// Remove the entries of a single appliance, along with the appliance list
+func cacheInvalidateAppliance(haId string) {
+	if haId == "" {
+		return
+	}
+	prefix := "/homeappliances/" + haId
+	cachePurge(func(p string) bool {
+		return p == "/homeappliances" || p == prefix || strings.HasPrefix(p, prefix+"/")
+	})
+}
+
+// Invalidate cached responses made outdated by the events on the bus
+func runCacheInvalidation() {
+	sub := eventbus.Subscribe("response cache", 100, eventbus.DropOldest)
+	for ev := range sub.Events() {
+		if !config.Cache.Enabled {
+			continue
+		}
+		invalidateForEvent(ev)
+	}
+}
+
+func invalidateForEvent(ev eventbus.Event) {
+	switch ev.Type {
+	case "PAIRED", "DEPAIRED", "CONNECTED", "DISCONNECTED":
+		// connection state is part of the appliance list, and everything else may have changed meanwhile
+		cacheInvalidateAppliance(ev.HaID)
+		return
+	}
+
+	base := "/homeappliances/" + ev.HaID
+	for _, item := range ev.Items {
+		switch {
+		case item.Key == activeProgramKey || item.Key == selectedProgramKey || item.Key == "BSH.Common.Status.OperationState":
+			// the available programs and their constraints depend on the program and operation state
+			cachePurge(func(p string) bool {
+				return strings.HasPrefix(p, base+"/programs")
+			})
+		case item.URI != "":
+			// the item itself and the collection it belongs to
+			itemPath := strings.TrimPrefix(item.URI, "/api")
+			collection := path.Dir(itemPath)
+			cachePurge(func(p string) bool {
+				return p == itemPath || p == collection
+			})
+		}
+	}
+}
+
+// Serve the cache statistics upon GET to '/proxy/cache', purge it upon DELETE.
+// '?path=' limits the purge to the entries with that path prefix.
+func cacheAdminHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodDelete {
+		prefix := r.URL.Query().Get("path")
+		removed := cachePurge(func(p string) bool {
+			return strings.HasPrefix(p, prefix)
+		})
+		logger.Info("Purged {n} response cache entries for '{prefix}'", "n", removed, "prefix", prefix)
+		json.NewEncoder(w).Encode(map[string]int{"purged": removed})
+		return
+	}
+
+	cacheMu.Lock()
+	paths := make([]string, 0, len(cacheEntries))
+	for _, e := range cacheEntries {
+		paths = append(paths, e.path)
+	}
+	stats := map[string]interface{}{
+		"enabled": config.Cache.Enabled,
+		"entries": len(cacheEntries),
+		"hits":    cacheHits,
+		"misses":  cacheMisses,
+	}
+	cacheMu.Unlock()
+	sort.Strings(paths)
+	stats["paths"] = paths
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import "github.com/ananchev/homeconnect-proxy/internal/metrics"
+
+// Config holds the settings of the optional proxy features
+type Config struct {
+	State      StateConfig
+	Cache      CacheConfig
+	Governor   GovernorConfig
+	Retry      RetryConfig
+	Aliases    AliasConfig
+	Validation ValidationConfig
+	AccessLog  AccessLogConfig
+	Metrics    metrics.Config
+}
+
+var config Config
+
+// Configure sets the proxy feature settings, it must be called before Run
+func Configure(cfg Config) {
+	config = cfg
+	cacheRoutes = orderRoutes(cfg.Cache.TTLs)
+	timeoutRoutes = orderRoutes(cfg.Retry.Timeouts)
+	configureGovernor(cfg.Governor)
+	buildAliases()
+}
+
+// Reconfigure returns the function applying new settings to the running proxy. Only the
+// aliases are replaced, the other settings take effect on the next start.
+func Reconfigure(cfg Config) func() {
+	return func() {
+		aliasesMu.Lock()
+		config.Aliases = cfg.Aliases
+		aliasesMu.Unlock()
+		buildAliases()
+	}
+}
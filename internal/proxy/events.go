@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/metrics"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// SSE field names
+	eventName = "event"
+	dataName  = "data"
+	eqidName  = "id"
+
+	// the Home Connect sse stream endpoint for all devices
+	eventsEndpoint = "/homeappliances/events"
+
+	// event type sent by Home Connect to keep the connection open
+	keepAliveEvent = "KEEP-ALIVE"
+)
+
+// reconnect delays of the upstream event stream
+const (
+	minStreamBackoff = 1 * time.Second
+	maxStreamBackoff = 5 * time.Minute
+)
+
+// Keep a single connection to the Home Connect event stream open and publish
+// all received events on the event bus. Reconnects with backoff when the stream ends.
+func runEventStream() {
+	backoff := minStreamBackoff
+	for {
+		connected, err := consumeEventStream()
+		noteStream(false, err)
+		if isStopping() {
+			logger.Info("Home Connect event stream closed")
+			return
+		}
+		if connected {
+			// the stream was up, so start over with the short delay
+			backoff = minStreamBackoff
+		}
+		if err != nil {
+			logger.Error("Home Connect event stream interrupted: '{err}', reconnecting in {delay}", "err", err.Error(), "delay", backoff)
+		} else {
+			logger.Info("Home Connect event stream closed, reconnecting in {delay}", "delay", backoff)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stopping:
+			return
+		}
+		metrics.StreamReconnecting()
+		backoff *= 2
+		if backoff > maxStreamBackoff {
+			backoff = maxStreamBackoff
+		}
+	}
+}
+
+// Open the upstream stream and parse it until it ends. Returns whether the connection got established.
+func consumeEventStream() (connected bool, err error) {
+	// the span covers establishing the connection, not the lifetime of the stream
+	ctx, span := tracing.Start(streamCtx, "Event stream connect", attribute.String("http.url", BaseURL+eventsEndpoint))
+	defer func() {
+		if !connected {
+			tracing.End(span, err)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, BaseURL+eventsEndpoint, nil)
+	if err != nil {
+		return
+	}
+	if err = acquireQuota(ctx, quotaStreams); err != nil {
+		return
+	}
+	token, err := getToken(ctx)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	// no timeout here, the stream is expected to stay open
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		upstreamRateLimited(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("unexpected response status " + resp.Status)
+		return
+	}
+	connected = true
+	span.End()
+	logger.Info("Connected to the Home Connect event stream")
+	metrics.StreamConnected(true)
+	noteStream(true, nil)
+	defer metrics.StreamConnected(false)
+	if loadAppliances() == nil {
+		go bootstrapStates()
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var lines []string
+	for scanner.Scan() {
+		text := scanner.Text()
+		// events in the stream are separated by empty line
+		if len(text) > 0 {
+			lines = append(lines, text)
+			continue
+		}
+		// empty line separator reached -> full event data read
+		if ev, ok := parseEvent(lines); ok {
+			enrichEvent(&ev)
+			metrics.EventReceived(ev)
+			eventbus.Publish(ev)
+		}
+		lines = nil
+	}
+	err = scanner.Err()
+	return
+}
+
+// Convert the lines of a single server-sent event into an event bus event.
+// Keep-alive and incomplete events are reported as not ok.
+func parseEvent(lines []string) (ev eventbus.Event, ok bool) {
+	for _, line := range lines {
+		// split by the first occurence of ':'
+		spl := strings.SplitN(line, ":", 2)
+		if len(spl) != 2 {
+			continue
+		}
+		value := strings.TrimPrefix(spl[1], " ")
+		switch spl[0] {
+		case eventName:
+			ev.Type = value
+		case dataName:
+			ev.Data = value
+		case eqidName:
+			ev.HaID = value
+		}
+	}
+	if ev.Type == "" || ev.Type == keepAliveEvent {
+		return
+	}
+
+	items, err := eventbus.ParseItems(ev.Data)
+	if err != nil {
+		logger.Error("Error decoding items of '{type}' event for '{haId}': '{err}'", "type", ev.Type, "haId", ev.HaID, "err", err.Error())
+	}
+	ev.Items = items
+	ev.Received = time.Now()
+	logger.Debug("'{type}' event with {n} item(s) received for '{haId}'", "type", ev.Type, "n", len(items), "haId", ev.HaID)
+	ok = true
+	return
+}
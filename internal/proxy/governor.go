@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// GovernorConfig holds the local quotas enforced before requests reach Home Connect.
+// The defaults stay a little below the limits Home Connect enforces per client and user.
+type GovernorConfig struct {
+	Enabled          bool          `env:"GOVERNOR" env-description:"Enforce the request quotas locally, before Home Connect locks the account" env-default:"true"`
+	PerMinute        int           `env:"GOVERNOR_PER_MINUTE" env-description:"API requests allowed per minute" env-default:"45"`
+	PerDay           int           `env:"GOVERNOR_PER_DAY" env-description:"API requests allowed per day" env-default:"950"`
+	RefreshesPerDay  int           `env:"GOVERNOR_REFRESHES_PER_DAY" env-description:"Token refreshes allowed per day" env-default:"90"`
+	StreamsPerMinute int           `env:"GOVERNOR_STREAMS_PER_MINUTE" env-description:"Event stream connects allowed per minute" env-default:"5"`
+	MaxWait          time.Duration `env:"GOVERNOR_MAX_WAIT" env-description:"Requests are queued if the quota frees up within this time, rejected otherwise" env-default:"5s"`
+}
+
+// kinds of upstream calls with a quota
+const (
+	quotaRequests  = "requests"
+	quotaRefreshes = "refreshes"
+	quotaStreams   = "streams"
+)
+
+// RateLimitError is returned for requests which are not sent to Home Connect because a quota is exhausted
+type RateLimitError struct {
+	Quota      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s quota exhausted, retry after %s", e.Quota, e.RetryAfter.Round(time.Second))
+}
+
+// sliding window of the calls made within a period
+type window struct {
+	period time.Duration
+	limit  int
+	calls  []time.Time
+}
+
+func (w *window) prune(now time.Time) {
+	i := 0
+	for i < len(w.calls) && now.Sub(w.calls[i]) >= w.period {
+		i++
+	}
+	w.calls = w.calls[i:]
+}
+
+// Time until the window has room for another call, zero if it has room now
+func (w *window) wait(now time.Time) time.Duration {
+	w.prune(now)
+	if w.limit <= 0 || len(w.calls) < w.limit {
+		return 0
+	}
+	return w.calls[len(w.calls)-w.limit].Add(w.period).Sub(now)
+}
+
+// quotas of a single Home Connect account
+type account struct {
+	windows      map[string][]*window
+	blockedUntil time.Time
+}
+
+var (
+	governorMu sync.Mutex
+	accounts   = map[string]*account{}
+)
+
+// The quotas are tracked per client ID, as Home Connect counts them per client and user
+func currentAccount() *account {
+	id := clientData.ClientId
+	a, ok := accounts[id]
+	if !ok {
+		a = &account{windows: map[string][]*window{
+			quotaRequests: {
+				{period: time.Minute},
+				{period: 24 * time.Hour},
+			},
+			quotaRefreshes: {{period: 24 * time.Hour}},
+			quotaStreams:   {{period: time.Minute}},
+		}}
+		a.setLimits(config.Governor)
+		accounts[id] = a
+	}
+	return a
+}
+
+// Set the limits of the quota windows, keeping the calls already made
+func (a *account) setLimits(cfg GovernorConfig) {
+	a.windows[quotaRequests][0].limit = cfg.PerMinute
+	a.windows[quotaRequests][1].limit = cfg.PerDay
+	a.windows[quotaRefreshes][0].limit = cfg.RefreshesPerDay
+	a.windows[quotaStreams][0].limit = cfg.StreamsPerMinute
+}
+
+// Apply the configured limits to the accounts tracked so far
+func configureGovernor(cfg GovernorConfig) {
+	governorMu.Lock()
+	defer governorMu.Unlock()
+	for _, a := range accounts {
+		a.setLimits(cfg)
+	}
+}
+
+// Take a slot of the quota, waiting up to the configured maximum in total for one to free up.
+// Returns a RateLimitError if the call must not be made, or the error of the context if it ends first.
+func acquireQuota(ctx context.Context, quota string) error {
+	if !config.Governor.Enabled {
+		return nil
+	}
+	deadline := time.Now().Add(config.Governor.MaxWait)
+	for {
+		governorMu.Lock()
+		a := currentAccount()
+		now := time.Now()
+
+		wait := a.blockedUntil.Sub(now)
+		for _, w := range a.windows[quota] {
+			if ww := w.wait(now); ww > wait {
+				wait = ww
+			}
+		}
+		if wait <= 0 {
+			for _, w := range a.windows[quota] {
+				w.calls = append(w.calls, now)
+			}
+			governorMu.Unlock()
+			return nil
+		}
+		governorMu.Unlock()
+
+		if now.Add(wait).After(deadline) {
+			logger.Error("Rejecting Home Connect call, {quota} quota exhausted for {wait}", "quota", quota, "wait", wait.Round(time.Second))
+			return &RateLimitError{Quota: quota, RetryAfter: wait}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Block all calls to Home Connect after it responded with 429, for the time it requested
+func upstreamRateLimited(resp *http.Response) {
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+
+	governorMu.Lock()
+	defer governorMu.Unlock()
+	a := currentAccount()
+	until := time.Now().Add(retryAfter)
+	if until.After(a.blockedUntil) {
+		a.blockedUntil = until
+	}
+	logger.Error("Home Connect rate limit reached, blocking all calls until {until}", "until", a.blockedUntil.Format(time.RFC3339))
+}
+
+// Read the Retry-After header, given either as seconds or as HTTP date. A minute if missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Sub(now)
+	}
+	return time.Minute
+}
+
+// Respond with 429 and Retry-After for calls rejected by the governor
+func renderRateLimited(w http.ResponseWriter, e *RateLimitError) {
+	secs := int(e.RetryAfter.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, e.Error(), http.StatusTooManyRequests)
+}
+
+// usage of a single quota window
+type quotaUsage struct {
+	Period    string    `json:"period"`
+	Used      int       `json:"used"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Resets    time.Time `json:"resets,omitempty"`
+}
+
+// Serve the current quota usage of the account upon request to '/proxy/quota'
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	governorMu.Lock()
+	a := currentAccount()
+	now := time.Now()
+	usage := map[string][]quotaUsage{}
+	for quota, windows := range a.windows {
+		for _, win := range windows {
+			win.prune(now)
+			u := quotaUsage{
+				Period:    win.period.String(),
+				Used:      len(win.calls),
+				Limit:     win.limit,
+				Remaining: win.limit - len(win.calls),
+			}
+			if len(win.calls) > 0 {
+				u.Resets = win.calls[0].Add(win.period)
+			}
+			if u.Remaining < 0 {
+				u.Remaining = 0
+			}
+			usage[quota] = append(usage[quota], u)
+		}
+	}
+	resp := map[string]interface{}{
+		"enabled": config.Governor.Enabled,
+		"quotas":  usage,
+	}
+	if a.blockedUntil.After(now) {
+		resp["blockedUntil"] = a.blockedUntil
+	}
+	governorMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
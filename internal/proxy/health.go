@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// Version of the proxy, set by main
+var Version = "dev"
+
+// Check returns nil if a subsystem is ready, the reason otherwise
+type Check func() error
+
+// CheckResult is the outcome of a readiness check
+type CheckResult struct {
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var (
+	startedAt = time.Now()
+
+	checksMu sync.Mutex
+	checks   = map[string]Check{}
+
+	diagnosticsMu sync.Mutex
+	diagnostics   = map[string]func() interface{}{}
+
+	// outcome of the last request to Home Connect
+	upstreamMu        sync.Mutex
+	upstreamLastOK    time.Time
+	upstreamLastErr   error
+	upstreamLastErrAt time.Time
+
+	// state of the Home Connect event stream
+	streamMu        sync.Mutex
+	streamConnected bool
+	streamSince     time.Time
+	streamLastErr   error
+)
+
+// time a failed request to Home Connect keeps the proxy not ready, unless a later one succeeds
+const upstreamErrorWindow = time.Minute
+
+// RegisterCheck adds a readiness check reported by '/readyz', e.g. of the event sinks
+func RegisterCheck(name string, check Check) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+	checks[name] = check
+}
+
+// RegisterDiagnostics adds a section to '/proxy/diagnostics', the function returns its current content
+func RegisterDiagnostics(name string, section func() interface{}) {
+	diagnosticsMu.Lock()
+	defer diagnosticsMu.Unlock()
+	diagnostics[name] = section
+}
+
+// noteUpstreamResult keeps if Home Connect was reachable at the last request
+func noteUpstreamResult(err error) {
+	upstreamMu.Lock()
+	defer upstreamMu.Unlock()
+	if err != nil {
+		upstreamLastErr = err
+		upstreamLastErrAt = time.Now()
+		return
+	}
+	upstreamLastOK = time.Now()
+	upstreamLastErr = nil
+}
+
+// noteStream keeps the state of the Home Connect event stream
+func noteStream(connected bool, err error) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	if connected != streamConnected {
+		streamSince = time.Now()
+	}
+	streamConnected = connected
+	if err != nil {
+		streamLastErr = err
+	}
+}
+
+func checkToken() error {
+	token, err := loadCachedToken()
+	if err != nil {
+		return errors.New("not authorized, authorize via '/proxy/auth'")
+	}
+	if epochSeconds() > token.ExpiresAt && token.RefreshToken == "" {
+		return errors.New("access token expired and no refresh token, authorize via '/proxy/auth'")
+	}
+	return nil
+}
+
+func checkUpstream() error {
+	upstreamMu.Lock()
+	defer upstreamMu.Unlock()
+	// an idle proxy is not kept unready by an old error
+	if upstreamLastErr != nil && time.Since(upstreamLastErrAt) < upstreamErrorWindow {
+		return fmt.Errorf("last request failed: %s", logger.Redact(upstreamLastErr.Error()))
+	}
+	return nil
+}
+
+func checkStream() error {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	if streamConnected {
+		return nil
+	}
+	if streamLastErr != nil {
+		return fmt.Errorf("event stream not connected: %s", logger.Redact(streamLastErr.Error()))
+	}
+	return errors.New("event stream not connected")
+}
+
+// readiness runs the built-in and registered checks
+func readiness() (ready bool, results map[string]CheckResult) {
+	all := map[string]Check{
+		"token":    checkToken,
+		"upstream": checkUpstream,
+		"stream":   checkStream,
+	}
+	checksMu.Lock()
+	for name, c := range checks {
+		all[name] = c
+	}
+	checksMu.Unlock()
+
+	ready = true
+	results = make(map[string]CheckResult, len(all))
+	for name, check := range all {
+		if err := check(); err != nil {
+			ready = false
+			results[name] = CheckResult{Reason: err.Error()}
+			continue
+		}
+		results[name] = CheckResult{OK: true}
+	}
+	return
+}
+
+// Respond to '/healthz' as long as the process serves requests
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Respond to '/readyz' with the readiness checks, status 503 if any failed
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready, results := readiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "checks": results})
+}
+
+// Serve the state of the proxy and its subsystems upon request to '/proxy/diagnostics'
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	ready, results := readiness()
+	d := map[string]interface{}{
+		"version":    Version,
+		"go":         runtime.Version(),
+		"started":    startedAt,
+		"uptime":     time.Since(startedAt).Round(time.Second).String(),
+		"goroutines": runtime.NumGoroutine(),
+		"ready":      ready,
+		"checks":     results,
+		"token":      tokenDiagnostics(),
+		"stream":     streamDiagnostics(),
+		"appliances": applianceDiagnostics(),
+		"bus":        map[string]int{"subscribers": eventbus.Default.Subscribers()},
+	}
+	cacheMu.Lock()
+	d["cache"] = map[string]interface{}{"enabled": config.Cache.Enabled, "entries": len(cacheEntries), "hits": cacheHits, "misses": cacheMisses}
+	cacheMu.Unlock()
+	stateMu.RLock()
+	d["state"] = map[string]interface{}{"enabled": config.State.Enabled, "appliances": len(states)}
+	stateMu.RUnlock()
+
+	diagnosticsMu.Lock()
+	for name, section := range diagnostics {
+		d[name] = section()
+	}
+	diagnosticsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(d)
+}
+
+// tokenDiagnostics describes the cached token without any of its secrets
+func tokenDiagnostics() map[string]interface{} {
+	token, err := loadCachedToken()
+	if err != nil {
+		return map[string]interface{}{"authorized": false}
+	}
+	return map[string]interface{}{
+		"authorized":    true,
+		"expires":       time.Unix(token.ExpiresAt, 0),
+		"expired":       epochSeconds() > token.ExpiresAt,
+		"refresh_token": token.RefreshToken != "",
+		"scope":         token.Scope,
+	}
+}
+
+func streamDiagnostics() map[string]interface{} {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	d := map[string]interface{}{"connected": streamConnected}
+	if !streamSince.IsZero() {
+		d["since"] = streamSince
+	}
+	if streamLastErr != nil {
+		d["last_error"] = logger.Redact(streamLastErr.Error())
+	}
+	upstreamMu.Lock()
+	if !upstreamLastOK.IsZero() {
+		d["last_upstream_response"] = upstreamLastOK
+	}
+	upstreamMu.Unlock()
+	return d
+}
+
+func applianceDiagnostics() []map[string]interface{} {
+	list := []map[string]interface{}{}
+	for haId, a := range Appliances() {
+		list = append(list, map[string]interface{}{
+			"haId":      haId,
+			"alias":     Alias(haId),
+			"type":      a.Type,
+			"connected": a.Connected,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["haId"].(string) < list[j]["haId"].(string) })
+	return list
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/metrics"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// RequestIDHeader carries the ID of a request, taken from the client if given and returned in the response
+const RequestIDHeader = "X-Request-ID"
+
+// traceRequests starts a span for every served request, continuing the trace of the client or internal caller
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		ctx, span := tracing.StartServer(r, r.Method+" "+route,
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.String("net.peer.name", r.RemoteAddr),
+		)
+		defer span.End()
+
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(ctx))
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// requestContext adds a logger with the request ID, route and haId to the request context
+func requestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		rec := accessRecordFrom(r.Context())
+		if rec == nil {
+			rec = &accessRecord{}
+		}
+		rec.RequestID = id
+		fields := []interface{}{"request_id", id}
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				fields = append(fields, "route", tpl)
+				rec.Route = tpl
+			}
+		}
+		if haId := haIdFromPath(r.URL.Path); haId != "" {
+			fields = append(fields, "haId", haId)
+			rec.HaID = haId
+		}
+		if traceId := tracing.TraceID(r.Context()); traceId != "" {
+			fields = append(fields, "trace_id", traceId)
+		}
+		next.ServeHTTP(w, r.WithContext(logger.NewContext(r.Context(), logger.With(fields...))))
+	})
+}
+
+// Serve the log level upon GET to '/proxy/log/level', change it with PUT '?level=debug'
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		level, err := logger.ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.SetLevel(level)
+		logger.FromContext(r.Context()).Info("Log level set to '{level}'", "level", level)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": logger.GetLevel().String()})
+}
+
+// instrumentRequests records the served requests in the metrics, by route template
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		started := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.ObserveRequest(route, r.Method, status, time.Since(started))
+	})
+}
@@ -1,15 +1,20 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/metrics"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -26,8 +31,12 @@ type ClientData struct {
 var clientData ClientData
 var routes string
 
+// serializes the token refreshes, a refresh token may be used only once
+var tokenMu sync.Mutex
+
 // Serialize token to disk for access when application is restarted, and for using the refresh token
 func cacheToken(token Token) (err error) {
+	registerSecrets(token)
 
 	data, err := json.Marshal(token)
 	if err != nil {
@@ -55,10 +64,16 @@ func loadCachedToken() (token Token, err error) {
 		logger.Error("Error unmarshalling token cache file: {err}", "err", err.Error())
 		return
 	}
+	registerSecrets(token)
 	return
 }
 
-func getToken() (token Token, err error) {
+// Keep the tokens out of the logs
+func registerSecrets(token Token) {
+	logger.RegisterSecret(token.AccessToken, token.RefreshToken, token.IdToken)
+}
+
+func getToken(ctx context.Context) (token Token, err error) {
 	token, err = loadCachedToken()
 	if err != nil {
 		err_descr := "Error getting token: " + err.Error()
@@ -67,32 +82,59 @@ func getToken() (token Token, err error) {
 	}
 
 	if epochSeconds() > token.ExpiresAt { //token has expired, refresh it
-		logger.Info("Access token has expired, initiating refresh...")
-		if token.RefreshToken == "" {
-			err_descr := "Refresh Token Not Found. Please re-authorize the application."
-			logger.Error(err_descr)
-			err = errors.New(err_descr)
+		tokenMu.Lock()
+		defer tokenMu.Unlock()
+		// another request may have refreshed it meanwhile
+		if token, err = loadCachedToken(); err != nil || epochSeconds() <= token.ExpiresAt {
 			return
 		}
-		var newToken Token
-		err = requestToken("REFRESH", token.RefreshToken, &newToken)
-		if err != nil {
-			logger.Info("Error getting new access token from refresh token: {error}", "error", err)
-			return
-		}
-		err = cacheToken(newToken)
-		if err != nil {
-			return
-		}
-		token = newToken
+		logger.Info("Access token has expired, initiating refresh...")
+		token, err = refreshToken(ctx, token)
+	}
+	return
+}
+
+// Refresh the access token even if not expired yet, used when Home Connect rejected it. Nothing
+// is done if the cached token is no longer the rejected one, as another request refreshed it meanwhile.
+func forceTokenRefresh(ctx context.Context, rejected string) (err error) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	token, err := loadCachedToken()
+	if err != nil || token.AccessToken != rejected {
+		return
+	}
+	logger.Info("Access token rejected by Home Connect, initiating refresh...")
+	_, err = refreshToken(ctx, token)
+	return
+}
+
+// Get a new access token using the refresh token, and cache it
+func refreshToken(ctx context.Context, token Token) (newToken Token, err error) {
+	if token.RefreshToken == "" {
+		err_descr := "Refresh Token Not Found. Please re-authorize the application."
+		logger.Error(err_descr)
+		err = errors.New(err_descr)
+		return
+	}
+	if err = acquireQuota(ctx, quotaRefreshes); err != nil {
+		return
+	}
+	err = requestToken(ctx, "REFRESH", token.RefreshToken, &newToken)
+	metrics.TokenRefreshed(err)
+	if err != nil {
+		logger.Info("Error getting new access token from refresh token: {error}", "error", err)
+		return
 	}
+	err = cacheToken(newToken)
 	return
 }
 
 // Get initial auth token, or refresh it using refresh token from cache
-func requestToken(requestType string, code string, token *Token) (err error) {
+func requestToken(ctx context.Context, requestType string, code string, token *Token) (err error) {
+	ctx, span := tracing.Start(ctx, "Token "+requestType, attribute.String("http.url", TokenURL))
+	defer func() { tracing.End(span, err) }()
 
-	logger.Info("Requesting new '{token}' token for API access ...", "token", requestType)
+	logger.Info("Requesting new '{type}' token for API access ...", "type", requestType)
 	// initate the payload values map, will add all values in the switch below, depending if requesting a new token, or refreshing it
 	values := url.Values{}
 	values.Set("client_secret", clientData.ClientSecret)
@@ -113,7 +155,7 @@ func requestToken(requestType string, code string, token *Token) (err error) {
 	}
 
 	// form a request with URL-encoded payload
-	req, err := http.NewRequest(http.MethodPost, TokenURL, strings.NewReader(values.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, TokenURL, strings.NewReader(values.Encode()))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	// send out the HTTP request
@@ -127,6 +169,7 @@ func requestToken(requestType string, code string, token *Token) (err error) {
 	}
 
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 	body, err := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode != 200 {
@@ -180,7 +223,7 @@ func requestToken(requestType string, code string, token *Token) (err error) {
 
 //get Access Token, refresh if expired, set header bearer token
 func setHeader(newReq *http.Request) (err error) {
-	token, err := getToken()
+	token, err := getToken(newReq.Context())
 	if err != nil {
 		err_descr := "Error getting access token: " + err.Error()
 		logger.Error(err_descr)
@@ -2,7 +2,11 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
+	"strings"
 	"text/template"
 	"time"
 
@@ -11,28 +15,61 @@ import (
 	"net/url"
 
 	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/metrics"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Documentation: https://api-docs.home-connect.com/authorization
 // Authorization URL: https://api.home-connect.com/security/oauth/authorize
 // Token URL: https://api.home-connect.com/security/oauth/token
 
-func Run(port string, hcClientId, hcClientSecret, hcClientScopes string) {
+func Run(port string, hcClientId, hcClientSecret, hcClientScopes string) error {
 	clientData.ClientId = hcClientId
 	clientData.ClientSecret = hcClientSecret
 	clientData.ClientScopes = hcClientScopes
+	logger.RegisterSecret(hcClientSecret)
 
 	r := mux.NewRouter()
+	r.Use(traceRequests, requestContext, instrumentRequests)
 	// proxy-specific routes
 	r.HandleFunc("/", homePageHandler)
 	r.HandleFunc("/proxy/auth", authPageHandler)
 	r.HandleFunc("/proxy/auth/redirect", redirectHandler)
 	r.HandleFunc("/proxy/success", authSuccessPageHandler)
+	r.HandleFunc("/proxy/state", statesHandler).Methods("GET")
+	r.HandleFunc("/proxy/state/{haId}", stateHandler).Methods("GET")
+	r.HandleFunc("/proxy/cache", cacheAdminHandler).Methods("GET", "DELETE")
+	r.HandleFunc("/proxy/quota", quotaHandler).Methods("GET")
+	r.HandleFunc("/proxy/aliases", aliasesHandler).Methods("GET")
+	r.HandleFunc("/proxy/log/level", logLevelHandler).Methods("GET", "PUT")
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	r.HandleFunc("/proxy/diagnostics", diagnosticsHandler).Methods("GET")
+	if config.Metrics.Enabled {
+		r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	}
+
+	// routes added by other subsystems
+	extraRoutesMu.Lock()
+	for _, er := range extraRoutes {
+		route := r.HandleFunc(er.path, er.handler)
+		if len(er.methods) > 0 {
+			route.Methods(er.methods...)
+		}
+	}
+	extraRoutesMu.Unlock()
 
 	// routes below will be redirected to home connect
 	// documentation available at https://apiclient.home-connect.com/
 
+	// event streams are served from the event bus, registered first as the
+	// generic appliance route below would match '/homeappliances/events' too
+	r.HandleFunc("/homeappliances/events", serverSentEventsHandler).Methods("GET")
+	r.HandleFunc("/homeappliances/{haId}/events", serverSentEventsHandler).Methods("GET")
+
 	// default
 	r.HandleFunc("/homeappliances", redirectToHomeConnect).Methods("GET")
 	r.HandleFunc("/homeappliances/{.*}", redirectToHomeConnect).Methods("GET")
@@ -49,19 +86,23 @@ func Run(port string, hcClientId, hcClientSecret, hcClientScopes string) {
 	r.HandleFunc("/homeappliances/{.*}/programs/selected/options/{.*}", redirectToHomeConnect).Methods("GET", "PUT")
 
 	// status
-	r.HandleFunc("/homeappliances/{.*}/status", redirectToHomeConnect).Methods("GET")
-	r.HandleFunc("/homeappliances/{.*}/status/{.*}", redirectToHomeConnect).Methods("GET")
+	r.HandleFunc("/homeappliances/{.*}/status", cachedStateHandler("status")).Methods("GET")
+	r.HandleFunc("/homeappliances/{.*}/status/{key}", cachedStateHandler("status")).Methods("GET")
 
-	// status event streams are proxied in separate go routine
-	go StartServerSentEventProxy()
+	// the upstream event stream feeds the event bus, state, response and constraints cache follow it, in separate go routines
+	go runStateCache()
+	go runCacheInvalidation()
+	go runConstraintsInvalidation()
+	go runEventStream()
 
 	// images
 	r.HandleFunc("/homeappliances/{.*}/images", redirectToHomeConnect).Methods("GET")
 	r.HandleFunc("/homeappliances/{.*}/images/{.*}", redirectToHomeConnect).Methods("GET")
 
 	// settings
-	r.HandleFunc("/homeappliances/{.*}/settings", redirectToHomeConnect).Methods("GET")
-	r.HandleFunc("/homeappliances/{.*}/settings/{.*}", redirectToHomeConnect).Methods("GET", "PUT")
+	r.HandleFunc("/homeappliances/{.*}/settings", cachedStateHandler("settings")).Methods("GET")
+	r.HandleFunc("/homeappliances/{.*}/settings/{key}", cachedStateHandler("settings")).Methods("GET")
+	r.HandleFunc("/homeappliances/{.*}/settings/{.*}", redirectToHomeConnect).Methods("PUT")
 
 	// commands
 	r.HandleFunc("/homeappliances/{.*}/commands", redirectToHomeConnect).Methods("GET")
@@ -69,11 +110,18 @@ func Run(port string, hcClientId, hcClientSecret, hcClientScopes string) {
 
 	getAllEndpoints(*r)
 
-	http.Handle("/", r)
+	openAccessLog()
+	handlerMu.Lock()
+	handler = accessLogger(aliasRewriter(r))
+	srv := &http.Server{Addr: ":" + port, Handler: handler}
+	server = srv
+	handlerMu.Unlock()
 	logger.Info("Web interface accessible at http://localhost:{port}", "port", port)
 
-	http.ListenAndServe(":"+port, nil)
-	return
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 // Collect all endpoints into the routes global variable. This will be served upon accessing the '/'
@@ -90,9 +138,6 @@ func getAllEndpoints(r mux.Router) {
 		routes += "\t" + t + "\r\n"
 		return nil
 	})
-	//manually add the additional two SSE handles for complete list
-	routes += "\t" + "/homeappliances/{.*}/events" + "\r\n"
-	routes += "\t" + "/homeappliances/events" + "\r\n"
 }
 
 // Serve the available endpoints upon request to '/'
@@ -160,16 +205,18 @@ func authSuccessPageHandler(w http.ResponseWriter, r *http.Request) {
 func redirectHandler(w http.ResponseWriter, r *http.Request) {
 	m, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		logger.Error("Redirect Error: {query} {error}", "error", r.URL.RawQuery, err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("Redirect Error: {query} {error}", "query", r.URL.RawQuery, "error", err.Error())
+		http.Error(w, logger.Redact(err.Error()), http.StatusInternalServerError)
 		return
 	}
 	code := m.Get("code")
 
 	var token Token
-	err = requestToken("AUTHORIZE", code, &token)
+	tokenMu.Lock()
+	err = requestToken(r.Context(), "AUTHORIZE", code, &token)
+	tokenMu.Unlock()
 	if err != nil {
-		http.Error(w, "Error geting token: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error geting token: "+logger.Redact(err.Error()), http.StatusInternalServerError)
 		return
 	}
 
@@ -178,39 +225,178 @@ func redirectHandler(w http.ResponseWriter, r *http.Request) {
 
 // redirect the requests to the Home Connect API
 func redirectToHomeConnect(w http.ResponseWriter, r *http.Request) {
+	if validateProgramRequest(w, r) {
+		return
+	}
+	entry, cacheable := cacheLookup(r)
+	if entry != nil {
+		renderCached(w, entry)
+		return
+	}
+	if r.Method != http.MethodGet {
+		// a command may change anything cached for the appliance
+		cacheInvalidateAppliance(haIdFromPath(r.URL.Path))
+	}
+
 	resp, err := apiRequest(r)
+	noteUpstream(r, resp, err)
+	if cacheable && err == nil {
+		resp = cacheStore(r, resp)
+	}
+	if err == nil {
+		resp = withAliases(r.URL.Path, resp)
+	}
 	renderResult(w, resp, err)
 }
 
 // Render the returned by Home Connect JSON
 func renderResult(w http.ResponseWriter, response *http.Response, err error) {
+	if rle, ok := err.(*RateLimitError); ok {
+		renderRateLimited(w, rle)
+		return
+	}
 	if err != nil {
+		http.Error(w, "Error forwarding request to Home Connect: "+logger.Redact(err.Error()), http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
+		http.Error(w, "Error reading Home Connect response: "+logger.Redact(err.Error()), http.StatusBadGateway)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/text")
+	contentType := response.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/text"
+	}
+	w.Header().Set("Content-Type", contentType)
+	for _, h := range []string{"Cache-Control", "X-Cache", "Age", "Retry-After"} {
+		if v := response.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
 	w.Write(body)
 	return
 }
 
+// request headers passed on to Home Connect
+var forwardedHeaders = []string{"Accept-Language"}
+
 // Wrapper function to make API requests to Home Connect
 func apiRequest(proxyRequest *http.Request) (response *http.Response, err error) {
 	endpoint := proxyRequest.URL.Path
+	if proxyRequest.URL.RawQuery != "" {
+		endpoint += "?" + proxyRequest.URL.RawQuery
+	}
 	method := proxyRequest.Method
-	logger.Info("'{method}' request to '{endpoint}' received", "method", method, "endpoint", endpoint)
+	log := logger.FromContext(proxyRequest.Context())
+	log.Info("'{method}' request to '{endpoint}' received", "method", method, "endpoint", endpoint)
+
+	header := http.Header{}
+	for _, h := range forwardedHeaders {
+		if v := proxyRequest.Header.Get(h); v != "" {
+			header.Set(h, v)
+		}
+	}
+	response, err = upstreamRequest(proxyRequest.Context(), method, endpoint, proxyRequest.Body, header)
+	if err != nil {
+		log.Warn("'{method}' request to '{endpoint}' failed: {error}", "method", method, "endpoint", endpoint, "error", err)
+	} else {
+		log.Debug("'{method}' request to '{endpoint}' answered with '{status}'", "method", method, "endpoint", endpoint, "status", response.Status)
+	}
+	return
+}
+
+// Make a request to the Home Connect API endpoint, authorized with the cached access token.
+// Failed attempts are repeated as far as the retry policy of the route allows.
+func upstreamRequest(ctx context.Context, method string, endpoint string, body io.Reader, header http.Header) (response *http.Response, err error) {
+	ctx, span := tracing.Start(ctx, "Home Connect "+method,
+		attribute.String("http.method", method),
+		attribute.String("hc.endpoint", endpoint),
+	)
+	defer func() {
+		if err == nil {
+			span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+		}
+		tracing.End(span, err)
+	}()
+
+	var payload []byte
+	if body != nil {
+		// kept for repeating the request
+		if payload, err = ioutil.ReadAll(body); err != nil {
+			return
+		}
+	}
+	routePath := strings.SplitN(endpoint, "?", 2)[0]
+	policy := retryPolicyFor(method, routePath)
+	timeout := requestTimeout(routePath)
+
+	refreshed := false
+	for attempt := 1; ; attempt++ {
+		response, err = doUpstream(ctx, method, endpoint, payload, header, timeout)
+
+		// an expired or revoked token is refreshed once, the request was not executed
+		if err == nil && response.StatusCode == http.StatusUnauthorized && !refreshed {
+			refreshed = true
+			rejected := strings.TrimPrefix(response.Request.Header.Get("Authorization"), "Bearer ")
+			if forceTokenRefresh(ctx, rejected) == nil {
+				discard(response)
+				attempt--
+				continue
+			}
+		}
+
+		retry, replacement := shouldRetry(ctx, policy, method, routePath, payload, response, err)
+		if replacement != nil {
+			discard(response)
+			return replacement, nil
+		}
+		if !retry || attempt >= config.Retry.Attempts {
+			return
+		}
+
+		delay := retryBackoff(attempt)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("delay", delay.String())))
+		if err != nil {
+			logger.Warn("'{method}' request to '{endpoint}' failed, retrying in {delay}: '{err}'", "method", method, "endpoint", endpoint, "delay", delay, "err", err.Error())
+		} else {
+			logger.Warn("'{method}' request to '{endpoint}' failed, retrying in {delay}: '{status}'", "method", method, "endpoint", endpoint, "delay", delay, "status", response.Status)
+		}
+		discard(response)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Perform a single request to Home Connect
+func doUpstream(ctx context.Context, method string, endpoint string, payload []byte, header http.Header, timeout time.Duration) (response *http.Response, err error) {
 	var client = &http.Client{
-		Timeout: time.Second * 10,
+		Timeout: timeout,
+	}
+
+	ctx, span := tracing.Start(ctx, "HTTP "+method, attribute.String("http.url", BaseURL+endpoint))
+	defer func() { tracing.End(span, err) }()
+
+	if err = acquireQuota(ctx, quotaRequests); err != nil {
+		return
 	}
 
-	request, err := http.NewRequest(method, BaseURL+endpoint, proxyRequest.Body)
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, BaseURL+endpoint, body)
 	if err != nil {
 		return
 	}
+	for h, v := range header {
+		request.Header[h] = v
+	}
 
 	err = setHeader(request)
 	if err != nil {
@@ -219,6 +405,36 @@ func apiRequest(proxyRequest *http.Request) (response *http.Response, err error)
 		err = errors.New(err_descr)
 		return
 	}
+	started := time.Now()
 	response, err = client.Do(request)
+	status := 0
+	if err == nil {
+		status = response.StatusCode
+		span.SetAttributes(attribute.Int("http.status_code", status))
+	}
+	metrics.ObserveUpstream(method, status, time.Since(started))
+	noteUpstreamResult(err)
+	if status == http.StatusTooManyRequests {
+		upstreamRateLimited(response)
+	}
+	return
+}
+
+// GET the Home Connect API endpoint and decode its JSON response into v
+func fetchJSON(endpoint string, v interface{}) (err error) {
+	resp, err := upstreamRequest(context.Background(), http.MethodGet, endpoint, nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("'" + endpoint + "' responded with " + resp.Status + ": " + string(body))
+		return
+	}
+	err = json.Unmarshal(body, v)
 	return
 }
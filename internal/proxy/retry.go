@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// RetryConfig holds the retry policy and timeouts of the requests to Home Connect
+type RetryConfig struct {
+	Attempts   int                      `env:"RETRY_ATTEMPTS" env-description:"Maximum attempts of a request which is safe to retry" env-default:"3"`
+	Backoff    time.Duration            `env:"RETRY_BACKOFF" env-description:"Delay before the first retry, doubled for every next one" env-default:"500ms"`
+	MaxBackoff time.Duration            `env:"RETRY_MAX_BACKOFF" env-description:"Upper bound of the delay between retries" env-default:"5s"`
+	Timeout    time.Duration            `env:"REQUEST_TIMEOUT" env-description:"Timeout of a single request to Home Connect" env-default:"10s"`
+	Timeouts   map[string]time.Duration `env:"REQUEST_TIMEOUTS" env-description:"Comma separated 'route:timeout' pairs overriding the timeout, '*' in a route matches a single path segment" env-default:"/homeappliances/*/images/*:30s,/homeappliances/*/programs/active:20s"`
+}
+
+// how a request may be repeated after a failure
+type retryPolicy int
+
+const (
+	// the request may be repeated at will, e.g. GET or setting a value
+	retryIdempotent retryPolicy = iota
+	// starting a program, repeated only if it is certain the program was not started
+	retryProgramStart
+	// only repeated if the request never reached Home Connect
+	retryUnsent
+)
+
+// Pick the retry policy by method and route
+func retryPolicyFor(method string, p string) retryPolicy {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		// deleting the active program stops it, stopping twice does no harm
+		return retryIdempotent
+	case http.MethodPut:
+		switch {
+		case strings.HasSuffix(p, "/programs/active"):
+			return retryProgramStart
+		case strings.Contains(p, "/commands/"):
+			// commands like pause and resume are not guaranteed to be repeatable
+			return retryUnsent
+		default:
+			// settings, selected program and options only set a value
+			return retryIdempotent
+		}
+	}
+	return retryUnsent
+}
+
+// the request timeouts ordered by route, set by Configure
+var timeoutRoutes []routeDuration
+
+// Timeout of a request to the path, of the most specific route matching it
+func requestTimeout(p string) time.Duration {
+	if t, ok := matchRoute(timeoutRoutes, p); ok {
+		return t
+	}
+	if config.Retry.Timeout > 0 {
+		return config.Retry.Timeout
+	}
+	return 10 * time.Second
+}
+
+// Delay before the retry following the given attempt
+func retryBackoff(attempt int) time.Duration {
+	d := config.Retry.Backoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= config.Retry.MaxBackoff {
+			return config.Retry.MaxBackoff
+		}
+	}
+	return d
+}
+
+// Failures which may be transient: network errors and gateway responses
+func transientFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		var rle *RateLimitError
+		return !errors.As(err, &rle)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Errors which guarantee the request was not sent, e.g. failing to connect
+func unsentFailure(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Decide if the failed attempt is repeated. For program starts the active program is checked first,
+// a started program turns the failure into success.
+func shouldRetry(ctx context.Context, policy retryPolicy, method string, endpoint string, payload []byte, resp *http.Response, err error) (retry bool, replacement *http.Response) {
+	if !transientFailure(resp, err) {
+		return
+	}
+	switch policy {
+	case retryIdempotent:
+		return true, nil
+	case retryUnsent:
+		return unsentFailure(err), nil
+	}
+
+	// program start
+	if unsentFailure(err) {
+		return true, nil
+	}
+	requested := programKey(payload)
+	active, checkErr := activeProgram(ctx, strings.TrimSuffix(endpoint, "/programs/active"))
+	if checkErr != nil {
+		// unknown if the program started, do not risk starting it twice
+		logger.Error("Not retrying program start on '{endpoint}', unable to check the active program: '{err}'", "endpoint", endpoint, "err", checkErr.Error())
+		return false, nil
+	}
+	if requested != "" && active == requested {
+		logger.Info("Program '{program}' started despite the failed response, not retrying", "program", requested)
+		return false, &http.Response{
+			Status:     "204 No Content",
+			StatusCode: http.StatusNoContent,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+	}
+	return true, nil
+}
+
+// Key of the program in a program start body
+func programKey(payload []byte) string {
+	var body struct {
+		Data struct {
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	json.Unmarshal(payload, &body)
+	return body.Data.Key
+}
+
+// Key of the active program of the appliance, empty if none
+func activeProgram(ctx context.Context, appliancePath string) (key string, err error) {
+	resp, err := doUpstream(ctx, http.MethodGet, appliancePath+"/programs/active", nil, nil, requestTimeout(appliancePath+"/programs/active"))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// no program active
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("active program responded with " + resp.Status)
+		return
+	}
+	var body struct {
+		Data struct {
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	key = body.Data.Key
+	return
+}
+
+// Discard the response of a failed attempt
+func discard(resp *http.Response) {
+	if resp != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
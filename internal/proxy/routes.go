@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// route added to the proxy by another subsystem
+type extraRoute struct {
+	path    string
+	handler http.HandlerFunc
+	methods []string
+}
+
+var (
+	extraRoutesMu sync.Mutex
+	extraRoutes   []extraRoute
+)
+
+// HandleFunc registers an additional proxy-specific route, e.g. an admin endpoint of an event sink.
+// Routes must be registered before Run is called.
+func HandleFunc(path string, handler http.HandlerFunc, methods ...string) {
+	extraRoutesMu.Lock()
+	defer extraRoutesMu.Unlock()
+	extraRoutes = append(extraRoutes, extraRoute{path, handler, methods})
+}
+
+// the complete proxy handler, set by Run
+var (
+	handlerMu sync.RWMutex
+	handler   http.Handler
+)
+
+// Call makes a request to a proxy endpoint on behalf of another subsystem. It is handled exactly like
+// a request from a client, e.g. '/homeappliances/hood/programs/active' is forwarded to Home Connect
+// with alias resolution, quota, retries and cache invalidation. The recorded response is returned.
+// The request continues the trace in the context.
+func Call(ctx context.Context, method string, path string, body []byte) (*Response, error) {
+	handlerMu.RLock()
+	h := handler
+	handlerMu.RUnlock()
+	if h == nil {
+		return nil, errors.New("proxy is not running")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// tells calls of the subsystems apart from clients in the access log
+	req.RemoteAddr = "internal"
+	w := &responseWriter{resp: Response{Header: http.Header{}}}
+	h.ServeHTTP(w, req)
+	if w.resp.Status == 0 {
+		w.resp.Status = http.StatusOK
+	}
+	w.resp.Body = w.body.Bytes()
+	return &w.resp, nil
+}
+
+// Response is the response of the proxy to a Call
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// responseWriter collects the response to a Call
+type responseWriter struct {
+	resp Response
+	body bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.resp.Header
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// WriteHeader records the status, only the first one counts like with a client connection
+func (w *responseWriter) WriteHeader(status int) {
+	if w.resp.Status == 0 {
+		w.resp.Status = status
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+var (
+	// the HTTP server started by Run, guarded by handlerMu
+	server *http.Server
+
+	// closed when the shutdown begins, ends the event streams
+	stopping     = make(chan struct{})
+	stoppingOnce sync.Once
+
+	// the upstream event stream request, cancelled on shutdown
+	streamCtx, streamCancel = context.WithCancel(context.Background())
+)
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the proxy. The Home Connect event stream is closed and the SSE clients are
+// disconnected, the requests in progress get until the context expires to complete. A token
+// refresh in progress is waited for, so the new token is cached. Run returns once the server is closed.
+func Shutdown(ctx context.Context) error {
+	stoppingOnce.Do(func() {
+		close(stopping)
+		streamCancel()
+	})
+
+	handlerMu.RLock()
+	srv := server
+	handlerMu.RUnlock()
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+
+	tokenMu.Lock()
+	tokenMu.Unlock()
+
+	if cerr := closeAccessLog(); err == nil {
+		err = cerr
+	}
+	return err
+}
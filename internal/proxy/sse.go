@@ -1,73 +1,74 @@
-// credits: https://github.com/doejon/Go-ServerSentEventProxy
 package proxy
 
 import (
-	"errors"
+	"fmt"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"time"
 
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
 	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-//Std http handler interface implementation
-type SSEProxy interface {
-	http.Handler
-}
-
-// Create a new sse proxy
-func NewSSEProxy(baseURL string) (SSEProxy, error) {
-
-	director := func(request *http.Request) {
-		// Form the request
-		fullURL := baseURL + request.URL.Path
-		u, err := url.Parse(fullURL)
-		if err != nil {
-			logger.Error("Error parsing sse url: '{error}'", "error", err)
-			return
-		}
-		request.URL = u
-		request.Host = u.Host
+const (
+	// queue size of every connected SSE client
+	sseClientQueue = 100
 
-		// Obtain access token
-		token, err := getToken()
-		if err != nil {
-			err_descr := "Error getting access token: " + err.Error()
-			logger.Error(err_descr)
-			err = errors.New(err_descr)
-			return
-		}
+	// interval at which keep-alive events are sent to idle SSE clients
+	sseKeepAlive = 55 * time.Second
+)
 
-		// Add all necessary headers
-		request.Header.Add("Authorization", "Bearer "+token.AccessToken)
-		request.Header.Add("X-Forwarded-Host", request.Host)
-		request.Header.Add("X-Origin-Host", u.Host)
-		request.Header.Add("Content-Type", "text/event-stream")
-		request.Header.Add("Cache-Control", "no-cache")
-		request.Header.Add("Connection", "keep-alive")
-		request.Header.Add("Transfer-Encoding", "chunked")
-		request.Header.Add("Access-Control-Allow-Origin", "*")
+// Serve the event stream of all appliances, or of a single one, to an SSE client.
+// Events are taken from the event bus, so no additional Home Connect stream is opened.
+func serverSentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
 	}
+	haId := mux.Vars(r)["haId"]
 
-	proxy := &httputil.ReverseProxy{Director: director}
-	proxy.FlushInterval = 100 * time.Millisecond
+	sub := eventbus.Subscribe("sse client "+r.RemoteAddr, sseClientQueue, eventbus.Disconnect)
+	defer sub.Close()
 
-	return proxy, nil
-}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-func StartServerSentEventProxy() {
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
 
-	sse, err := NewSSEProxy(BaseURL)
+	// the request span lasts as long as the client stays connected
+	sent := 0
+	defer func() {
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.Int("sse.events_sent", sent))
+	}()
 
-	if err != nil {
-		err_descr := "Error starting SSE proxy: " + err.Error()
-		logger.Error(err_descr)
-		err = errors.New(err_descr)
-		return
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.FromContext(r.Context()).Info("SSE client '{client}' disconnected", "client", r.RemoteAddr)
+			return
+		case <-stopping:
+			// ending the response lets the client reconnect to another instance
+			return
+		case <-keepAlive.C:
+			fmt.Fprintf(w, "event: %s\ndata: \n\n", keepAliveEvent)
+		case ev, open := <-sub.Events():
+			if !open {
+				return
+			}
+			if haId != "" && ev.HaID != haId {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\nid: %s\n\n", ev.Type, ev.Data, ev.HaID)
+			sent++
+		}
+		flusher.Flush()
 	}
-
-	http.Handle("/homeappliances/{.*}/events", sse)
-	http.Handle("/homeappliances/events", sse)
-
 }
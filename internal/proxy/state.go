@@ -0,0 +1,466 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/gorilla/mux"
+)
+
+// StateConfig holds the appliance state cache settings
+type StateConfig struct {
+	Enabled     bool `env:"STATE_CACHE" env-description:"Keep the state of every appliance in memory, updated from the event stream" env-default:"true"`
+	ServeCached bool `env:"STATE_SERVE_CACHED" env-description:"Answer GET requests to the status and settings endpoints out of the state cache" env-default:"false"`
+}
+
+const (
+	activeProgramKey   = "BSH.Common.Root.ActiveProgram"
+	selectedProgramKey = "BSH.Common.Root.SelectedProgram"
+)
+
+// StateItem is the last known value of a status, setting, option or event key
+type StateItem struct {
+	Key          string      `json:"key"`
+	Value        interface{} `json:"value,omitempty"`
+	Unit         string      `json:"unit,omitempty"`
+	Name         string      `json:"name,omitempty"`
+	DisplayValue string      `json:"displayvalue,omitempty"`
+	Updated      time.Time   `json:"updated"`
+}
+
+// ProgramState is the selected or active program along with its options
+type ProgramState struct {
+	Key     string               `json:"key"`
+	Options map[string]StateItem `json:"options"`
+}
+
+// ApplianceState is the in-memory copy of an appliance, bootstrapped from the API
+// and kept current by the items of the event stream
+type ApplianceState struct {
+	HaID            string               `json:"haId"`
+	Connected       bool                 `json:"connected"`
+	Status          map[string]StateItem `json:"status"`
+	Settings        map[string]StateItem `json:"settings"`
+	SelectedProgram *ProgramState        `json:"selectedProgram"`
+	ActiveProgram   *ProgramState        `json:"activeProgram"`
+	Events          map[string]StateItem `json:"events"`
+	Bootstrapped    time.Time            `json:"bootstrapped"`
+	Updated         time.Time            `json:"updated"`
+
+	// last change of the selected and active program by an event
+	selectedUpdated time.Time
+	activeUpdated   time.Time
+}
+
+var (
+	stateMu sync.RWMutex
+	states  = map[string]*ApplianceState{}
+)
+
+// State returns a copy of the cached appliance state, and whether there is any
+func State(haId string) (ApplianceState, bool) {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	s, ok := states[haId]
+	if !ok {
+		return ApplianceState{}, false
+	}
+	return s.copy(), true
+}
+
+// StateValue returns the cached value of a status, setting or program option key
+func StateValue(haId string, key string) (value interface{}, ok bool) {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	s, found := states[haId]
+	if !found {
+		return
+	}
+	for _, items := range []map[string]StateItem{s.Status, s.Settings, s.Events} {
+		if item, found := items[key]; found {
+			return item.Value, true
+		}
+	}
+	for _, p := range []*ProgramState{s.ActiveProgram, s.SelectedProgram} {
+		if p == nil {
+			continue
+		}
+		if item, found := p.Options[key]; found {
+			return item.Value, true
+		}
+	}
+	return
+}
+
+func newApplianceState(haId string) *ApplianceState {
+	return &ApplianceState{
+		HaID:     haId,
+		Status:   map[string]StateItem{},
+		Settings: map[string]StateItem{},
+		Events:   map[string]StateItem{},
+	}
+}
+
+func (s *ApplianceState) copy() ApplianceState {
+	c := *s
+	c.Status = copyItems(s.Status)
+	c.Settings = copyItems(s.Settings)
+	c.Events = copyItems(s.Events)
+	c.SelectedProgram = s.SelectedProgram.copy()
+	c.ActiveProgram = s.ActiveProgram.copy()
+	return c
+}
+
+func (p *ProgramState) copy() *ProgramState {
+	if p == nil {
+		return nil
+	}
+	return &ProgramState{Key: p.Key, Options: copyItems(p.Options)}
+}
+
+func copyItems(items map[string]StateItem) map[string]StateItem {
+	c := make(map[string]StateItem, len(items))
+	for k, v := range items {
+		c[k] = v
+	}
+	return c
+}
+
+// Keep the cache current with the events from the bus
+func runStateCache() {
+	sub := eventbus.Subscribe("state cache", 100, eventbus.Block)
+	for ev := range sub.Events() {
+		applyEvent(ev)
+	}
+}
+
+// Bootstrap all connected appliances, done whenever the event stream (re)connects as events may have been missed
+func bootstrapStates() {
+	if !config.State.Enabled {
+		return
+	}
+	for haId, a := range Appliances() {
+		if !a.Connected {
+			setConnected(haId, false)
+			continue
+		}
+		bootstrapState(haId)
+	}
+}
+
+// Load the status, settings and programs of the appliance from Home Connect into the cache.
+// Items changed by events while loading are newer than the loaded ones and kept.
+func bootstrapState(haId string) (err error) {
+	logger.Info("Bootstrapping state cache of '{haId}'", "haId", haId)
+	started := time.Now()
+	base := "/homeappliances/" + haId
+
+	var status struct {
+		Data struct {
+			Status []eventbus.Item `json:"status"`
+		} `json:"data"`
+	}
+	if err = fetchJSON(base+"/status", &status); err != nil {
+		logger.Error("Error bootstrapping status of '{haId}': '{err}'", "haId", haId, "err", err.Error())
+		return
+	}
+	var settings struct {
+		Data struct {
+			Settings []eventbus.Item `json:"settings"`
+		} `json:"data"`
+	}
+	if err = fetchJSON(base+"/settings", &settings); err != nil {
+		logger.Error("Error bootstrapping settings of '{haId}': '{err}'", "haId", haId, "err", err.Error())
+		return
+	}
+
+	now := time.Now()
+	fetched := newApplianceState(haId)
+	for _, item := range status.Data.Status {
+		fetched.Status[item.Key] = stateItem(item, now)
+	}
+	for _, item := range settings.Data.Settings {
+		fetched.Settings[item.Key] = stateItem(item, now)
+	}
+	// appliances without selected or active program respond with an error, which just means there is none
+	fetched.SelectedProgram = fetchProgram(base+"/programs/selected", now)
+	fetched.ActiveProgram = fetchProgram(base+"/programs/active", now)
+
+	// merge into the cached state, which keeps the events as the API has no endpoint to load them
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s, ok := states[haId]
+	if !ok {
+		s = newApplianceState(haId)
+		states[haId] = s
+	}
+	s.Connected = true
+	mergeItems(s.Status, fetched.Status, started)
+	mergeItems(s.Settings, fetched.Settings, started)
+	s.SelectedProgram = mergeProgram(s.SelectedProgram, s.selectedUpdated, fetched.SelectedProgram, started)
+	s.ActiveProgram = mergeProgram(s.ActiveProgram, s.activeUpdated, fetched.ActiveProgram, started)
+	s.Bootstrapped = now
+	s.Updated = now
+	return
+}
+
+// Replace the cached items by the loaded ones, except those updated by events since the load started
+func mergeItems(cached map[string]StateItem, loaded map[string]StateItem, started time.Time) {
+	for key, item := range cached {
+		if _, ok := loaded[key]; !ok && !item.Updated.After(started) {
+			delete(cached, key)
+		}
+	}
+	for key, item := range loaded {
+		if c, ok := cached[key]; ok && c.Updated.After(started) {
+			continue
+		}
+		cached[key] = item
+	}
+}
+
+// Replace the cached program by the loaded one, unless an event changed it since the load started
+func mergeProgram(cached *ProgramState, updated time.Time, loaded *ProgramState, started time.Time) *ProgramState {
+	if !updated.After(started) {
+		return loaded
+	}
+	if cached != nil && loaded != nil && cached.Key == loaded.Key {
+		mergeItems(cached.Options, loaded.Options, started)
+	}
+	return cached
+}
+
+func fetchProgram(endpoint string, now time.Time) *ProgramState {
+	var program struct {
+		Data struct {
+			Key     string          `json:"key"`
+			Options []eventbus.Item `json:"options"`
+		} `json:"data"`
+	}
+	if err := fetchJSON(endpoint, &program); err != nil || program.Data.Key == "" {
+		return nil
+	}
+	p := &ProgramState{Key: program.Data.Key, Options: map[string]StateItem{}}
+	for _, item := range program.Data.Options {
+		p.Options[item.Key] = stateItem(item, now)
+	}
+	return p
+}
+
+func stateItem(item eventbus.Item, updated time.Time) StateItem {
+	return StateItem{
+		Key:          item.Key,
+		Value:        item.Value,
+		Unit:         item.Unit,
+		Name:         item.Name,
+		DisplayValue: item.DisplayValue,
+		Updated:      updated,
+	}
+}
+
+func setConnected(haId string, connected bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s, ok := states[haId]
+	if !ok {
+		s = newApplianceState(haId)
+		states[haId] = s
+	}
+	s.Connected = connected
+	s.Updated = time.Now()
+}
+
+// Apply the items of an event to the cached appliance state
+func applyEvent(ev eventbus.Event) {
+	if !config.State.Enabled || ev.HaID == "" {
+		return
+	}
+
+	switch ev.Type {
+	case "CONNECTED", "PAIRED":
+		// the appliance may have changed while it was offline
+		go bootstrapState(ev.HaID)
+		return
+	case "DISCONNECTED":
+		setConnected(ev.HaID, false)
+		return
+	case "DEPAIRED":
+		stateMu.Lock()
+		delete(states, ev.HaID)
+		stateMu.Unlock()
+		return
+	case "STATUS", "NOTIFY", "EVENT":
+	default:
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s, ok := states[ev.HaID]
+	if !ok {
+		s = newApplianceState(ev.HaID)
+		s.Connected = true
+		states[ev.HaID] = s
+	}
+	for _, item := range ev.Items {
+		s.apply(ev.Type, item, ev.Received)
+	}
+	s.Updated = ev.Received
+}
+
+// Sort a single item into the state, by its uri where present, by its key otherwise
+func (s *ApplianceState) apply(eventType string, item eventbus.Item, received time.Time) {
+	si := stateItem(item, received)
+	uri := item.URI
+
+	switch {
+	case eventType == "EVENT":
+		s.Events[item.Key] = si
+	case item.Key == activeProgramKey:
+		s.ActiveProgram = programFromItem(s.ActiveProgram, item)
+		s.activeUpdated = received
+	case item.Key == selectedProgramKey:
+		s.SelectedProgram = programFromItem(s.SelectedProgram, item)
+		s.selectedUpdated = received
+	case strings.Contains(uri, "/programs/active/options/"):
+		s.ActiveProgram = setOption(s.ActiveProgram, si)
+		s.activeUpdated = received
+	case strings.Contains(uri, "/programs/selected/options/"):
+		s.SelectedProgram = setOption(s.SelectedProgram, si)
+		s.selectedUpdated = received
+	case strings.Contains(uri, "/settings/"):
+		s.Settings[item.Key] = si
+	case strings.Contains(uri, "/status/"):
+		s.Status[item.Key] = si
+	case strings.Contains(item.Key, ".Option."):
+		s.ActiveProgram = setOption(s.ActiveProgram, si)
+		s.activeUpdated = received
+	case strings.Contains(item.Key, ".Setting."):
+		s.Settings[item.Key] = si
+	default:
+		s.Status[item.Key] = si
+	}
+}
+
+// A program change starts with no options, they follow as separate items
+func programFromItem(p *ProgramState, item eventbus.Item) *ProgramState {
+	key, _ := item.Value.(string)
+	if key == "" {
+		return nil
+	}
+	if p != nil && p.Key == key {
+		return p
+	}
+	return &ProgramState{Key: key, Options: map[string]StateItem{}}
+}
+
+func setOption(p *ProgramState, item StateItem) *ProgramState {
+	if p == nil {
+		p = &ProgramState{Options: map[string]StateItem{}}
+	}
+	p.Options[item.Key] = item
+	return p
+}
+
+// Get the cached state, bootstrapping it first if requested or not present
+func currentState(haId string, refresh bool) (s ApplianceState, err error) {
+	s, ok := State(haId)
+	if refresh || !ok || s.Bootstrapped.IsZero() {
+		if err = bootstrapState(haId); err != nil {
+			return
+		}
+		s, _ = State(haId)
+	}
+	return
+}
+
+// Serve the cached state of an appliance upon request to '/proxy/state/{haId}'. '?refresh=true' reloads it from Home Connect first.
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.State.Enabled {
+		http.Error(w, "state cache is disabled", http.StatusNotFound)
+		return
+	}
+	haId := mux.Vars(r)["haId"]
+	s, err := currentState(haId, r.URL.Query().Get("refresh") == "true")
+	if err != nil {
+		http.Error(w, "Error loading state of '"+haId+"': "+logger.Redact(err.Error()), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", s.Updated.UTC().Format(http.TimeFormat))
+	json.NewEncoder(w).Encode(s)
+}
+
+// Serve the cached state of all appliances upon request to '/proxy/state'
+func statesHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.State.Enabled {
+		http.Error(w, "state cache is disabled", http.StatusNotFound)
+		return
+	}
+	stateMu.RLock()
+	list := make([]ApplianceState, 0, len(states))
+	for _, s := range states {
+		list = append(list, s.copy())
+	}
+	stateMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Serve GET requests to the status or settings endpoints of an appliance out of the cache, in the
+// Home Connect response format. Falls back to Home Connect if not enabled, or with '?refresh=true'.
+func cachedStateHandler(section string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config.State.Enabled || !config.State.ServeCached || r.URL.Query().Get("refresh") == "true" {
+			redirectToHomeConnect(w, r)
+			return
+		}
+		haId := haIdFromPath(r.URL.Path)
+		s, err := currentState(haId, false)
+		if err != nil {
+			redirectToHomeConnect(w, r)
+			return
+		}
+
+		items := s.Status
+		if section == "settings" {
+			items = s.Settings
+		}
+
+		var body interface{}
+		if key := mux.Vars(r)["key"]; key != "" {
+			item, ok := items[key]
+			if !ok {
+				// not known to the cache, let Home Connect answer
+				redirectToHomeConnect(w, r)
+				return
+			}
+			body = map[string]interface{}{"data": item}
+		} else {
+			list := make([]StateItem, 0, len(items))
+			for _, item := range items {
+				list = append(list, item)
+			}
+			body = map[string]interface{}{"data": map[string]interface{}{section: list}}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Cache", "STATE")
+		w.Header().Set("Last-Modified", s.Updated.UTC().Format(http.TimeFormat))
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// Get the haId out of a '/homeappliances/{haId}/...' path
+func haIdFromPath(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "homeappliances" {
+		return ""
+	}
+	return parts[1]
+}
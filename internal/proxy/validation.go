@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// ValidationConfig defines if program and option requests are checked against the program constraints
+type ValidationConfig struct {
+	Enabled bool          `env:"VALIDATE_PROGRAMS" env-description:"Validate program starts and option changes against the constraints of the program before forwarding them" env-default:"true"`
+	TTL     time.Duration `env:"VALIDATE_CONSTRAINTS_TTL" env-description:"How long the constraints of an available program are cached" env-default:"24h"`
+}
+
+// OptionConstraints are the allowed values of a program option, as served by '/programs/available/{programKey}'
+type OptionConstraints struct {
+	Key         string `json:"key"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit,omitempty"`
+	Constraints struct {
+		Min           *float64      `json:"min,omitempty"`
+		Max           *float64      `json:"max,omitempty"`
+		StepSize      *float64      `json:"stepsize,omitempty"`
+		AllowedValues []interface{} `json:"allowedvalues,omitempty"`
+		Access        string        `json:"access,omitempty"`
+	} `json:"constraints"`
+}
+
+// ProgramConstraints are the options of an available program and how it can be executed
+type ProgramConstraints struct {
+	Key         string `json:"key"`
+	Constraints struct {
+		Execution string `json:"execution,omitempty"` // selectonly, startonly or selectandstart
+	} `json:"constraints"`
+	Options []OptionConstraints `json:"options"`
+
+	fetched time.Time
+}
+
+// Violation describes why a request does not meet the program constraints
+type Violation struct {
+	Program    string      `json:"program"`
+	Option     string      `json:"option,omitempty"`
+	Constraint string      `json:"constraint"`
+	Allowed    interface{} `json:"allowed,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
+	Message    string      `json:"description"`
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+// programUnavailable is the constraint reported for programs the appliance does not offer
+const programUnavailable = "available"
+
+var (
+	constraintsMu sync.Mutex
+	constraints   = map[string]*ProgramConstraints{} // by haId and program key
+)
+
+// validateProgramRequest checks a PUT to a program or its options against the constraints of the
+// program. It renders a 422 on a violation, and the validation result on '?dryRun=true', reporting
+// if the request is done with.
+func validateProgramRequest(w http.ResponseWriter, r *http.Request) (done bool) {
+	query := r.URL.Query()
+	dryRun, _ := strconv.ParseBool(query.Get("dryRun"))
+	if query.Has("dryRun") {
+		query.Del("dryRun")
+		r.URL.RawQuery = query.Encode()
+	}
+	haId := haIdFromPath(r.URL.Path)
+	target, rest := programTarget(r.URL.Path)
+	if dryRun && (r.Method != http.MethodPut || target == "") {
+		// never forward a request the client meant to only validate
+		http.Error(w, "dryRun is supported for PUT to programs and program options only", http.StatusBadRequest)
+		return true
+	}
+	if r.Method != http.MethodPut || target == "" || (!config.Validation.Enabled && !dryRun) {
+		return false
+	}
+
+	payload, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	if err != nil {
+		return false
+	}
+
+	violation, err := validateProgram(r.Context(), haId, target, rest, payload)
+	switch {
+	case violation != nil:
+		logger.FromContext(r.Context()).Info("Rejected '{method}' '{path}': {violation}", "method", r.Method, "path", r.URL.Path, "violation", violation.Message)
+		renderViolation(w, violation)
+		return true
+	case err != nil && dryRun:
+		http.Error(w, "Unable to validate the request: "+logger.Redact(err.Error()), http.StatusBadGateway)
+		return true
+	case err != nil:
+		// constraints not at hand, e.g. the appliance is offline; Home Connect has the final word
+		logger.FromContext(r.Context()).Warn("Forwarding '{path}' unvalidated: {err}", "path", r.URL.Path, "err", err.Error())
+	case dryRun:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"valid": true}})
+		return true
+	}
+	return false
+}
+
+// programTarget returns 'active' or 'selected' for a program or program options path, along with the
+// path below 'options', e.g. ('active', 'options/Cooking.Oven.Option.SetpointTemperature')
+func programTarget(path string) (target string, rest string) {
+	segments := strings.SplitN(strings.Trim(path, "/"), "/", 5)
+	if len(segments) < 4 || segments[0] != "homeappliances" || segments[2] != "programs" {
+		return "", ""
+	}
+	if segments[3] != "active" && segments[3] != "selected" {
+		return "", ""
+	}
+	if len(segments) == 5 {
+		rest = segments[4]
+	}
+	return segments[3], rest
+}
+
+// validateProgram checks the body of a program or options request. A program request names the program,
+// for option requests the program is taken from the state cache and not validated if unknown.
+func validateProgram(ctx context.Context, haId string, target string, rest string, payload []byte) (*Violation, error) {
+	var body struct {
+		Data struct {
+			Key     string        `json:"key"`
+			Value   interface{}   `json:"value"`
+			Options []optionValue `json:"options"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	programKey := body.Data.Key
+	options := body.Data.Options
+	if rest != "" {
+		// options of the current program: a list, or a single option named by the path
+		programKey = currentProgram(haId, target)
+		if programKey == "" {
+			return nil, fmt.Errorf("%s program of '%s' is not known", target, haId)
+		}
+		if key := strings.TrimPrefix(rest, "options/"); key != rest {
+			options = []optionValue{{key, body.Data.Value}}
+		}
+	}
+	if programKey == "" {
+		return nil, fmt.Errorf("request names no program")
+	}
+
+	program, err := programConstraints(ctx, haId, programKey)
+	if err != nil {
+		return nil, err
+	}
+	if program == nil {
+		return &Violation{Program: programKey, Constraint: programUnavailable,
+			Message: fmt.Sprintf("program '%s' is not available on the appliance", programKey)}, nil
+	}
+	if rest == "" {
+		if v := checkExecution(program, target); v != nil {
+			return v, nil
+		}
+	}
+	for _, o := range options {
+		if v := checkOption(program, o.Key, o.Value); v != nil {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// optionValue is a program option in a request body
+type optionValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// currentProgram returns the key of the active or selected program from the state cache
+func currentProgram(haId string, target string) string {
+	s, ok := State(haId)
+	if !ok {
+		return ""
+	}
+	p := s.ActiveProgram
+	if target == "selected" {
+		p = s.SelectedProgram
+	}
+	if p == nil {
+		return ""
+	}
+	return p.Key
+}
+
+func checkExecution(p *ProgramConstraints, target string) *Violation {
+	execution := p.Constraints.Execution
+	if (target == "active" && execution == "selectonly") || (target == "selected" && execution == "startonly") {
+		return &Violation{Program: p.Key, Constraint: "execution", Allowed: execution,
+			Message: fmt.Sprintf("program '%s' can not be %s, its execution is '%s'", p.Key, map[string]string{"active": "started", "selected": "selected"}[target], execution)}
+	}
+	return nil
+}
+
+func checkOption(p *ProgramConstraints, key string, value interface{}) *Violation {
+	var option *OptionConstraints
+	for i := range p.Options {
+		if p.Options[i].Key == key {
+			option = &p.Options[i]
+		}
+	}
+	violation := func(constraint string, allowed interface{}, format string, args ...interface{}) *Violation {
+		return &Violation{Program: p.Key, Option: key, Constraint: constraint, Allowed: allowed, Value: value,
+			Message: fmt.Sprintf("option '%s': ", key) + fmt.Sprintf(format, args...)}
+	}
+	if option == nil {
+		return violation("option", nil, "not supported by program '%s'", p.Key)
+	}
+	c := option.Constraints
+	if c.Access == "read" {
+		return violation("access", c.Access, "is read-only")
+	}
+
+	if len(c.AllowedValues) > 0 {
+		for _, allowed := range c.AllowedValues {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				return nil
+			}
+		}
+		return violation("allowedvalues", c.AllowedValues, "value '%v' is not one of the allowed values", value)
+	}
+
+	switch option.Type {
+	case "Boolean":
+		if _, ok := value.(bool); !ok {
+			return violation("type", option.Type, "value '%v' is not a boolean", value)
+		}
+	case "String":
+		if _, ok := value.(string); !ok {
+			return violation("type", option.Type, "value '%v' is not a string", value)
+		}
+	case "Int", "Double":
+		n, ok := value.(float64)
+		if !ok {
+			return violation("type", option.Type, "value '%v' is not a number", value)
+		}
+		if option.Type == "Int" && n != math.Trunc(n) {
+			return violation("type", option.Type, "value %v is not an integer", n)
+		}
+		if c.Min != nil && n < *c.Min {
+			return violation("min", *c.Min, "value %v is below the minimum of %v%s", n, *c.Min, unit(option.Unit))
+		}
+		if c.Max != nil && n > *c.Max {
+			return violation("max", *c.Max, "value %v is above the maximum of %v%s", n, *c.Max, unit(option.Unit))
+		}
+		if c.StepSize != nil && *c.StepSize > 0 {
+			base := 0.0
+			if c.Min != nil {
+				base = *c.Min
+			}
+			steps := (n - base) / *c.StepSize
+			if math.Abs(steps-math.Round(steps)) > 1e-9 {
+				return violation("stepsize", *c.StepSize, "value %v is not a multiple of the step size %v from %v", n, *c.StepSize, base)
+			}
+		}
+	}
+	return nil
+}
+
+func unit(u string) string {
+	if u == "" {
+		return ""
+	}
+	return " " + u
+}
+
+// Drop the cached constraints made outdated by the events on the bus: the available programs and
+// their constraints depend on the selected and active program and the operation state, like the
+// cached responses of '/programs'
+func runConstraintsInvalidation() {
+	sub := eventbus.Subscribe("program constraints", 100, eventbus.DropOldest)
+	for ev := range sub.Events() {
+		if constraintsOutdated(ev) {
+			invalidateConstraints(ev.HaID)
+		}
+	}
+}
+
+func constraintsOutdated(ev eventbus.Event) bool {
+	switch ev.Type {
+	case "PAIRED", "DEPAIRED", "CONNECTED", "DISCONNECTED":
+		return true
+	}
+	for _, item := range ev.Items {
+		if item.Key == activeProgramKey || item.Key == selectedProgramKey || item.Key == "BSH.Common.Status.OperationState" {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the cached constraints of all programs of the appliance
+func invalidateConstraints(haId string) {
+	constraintsMu.Lock()
+	defer constraintsMu.Unlock()
+	for id := range constraints {
+		if strings.HasPrefix(id, haId+"/") {
+			delete(constraints, id)
+		}
+	}
+}
+
+// programConstraints returns the cached constraints of a program, fetching them when missing or expired.
+// A nil result without error means the appliance does not offer the program.
+func programConstraints(ctx context.Context, haId string, programKey string) (*ProgramConstraints, error) {
+	id := haId + "/" + programKey
+	constraintsMu.Lock()
+	p, ok := constraints[id]
+	constraintsMu.Unlock()
+	if ok && time.Since(p.fetched) < config.Validation.TTL {
+		return p, nil
+	}
+
+	endpoint := "/homeappliances/" + haId + "/programs/available/" + programKey
+	resp, err := upstreamRequest(ctx, http.MethodGet, endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("'%s' responded with %s", endpoint, resp.Status)
+	}
+
+	var available struct {
+		Data ProgramConstraints `json:"data"`
+	}
+	if err = json.Unmarshal(body, &available); err != nil {
+		return nil, err
+	}
+	p = &available.Data
+	p.fetched = time.Now()
+	constraintsMu.Lock()
+	constraints[id] = p
+	constraintsMu.Unlock()
+	return p, nil
+}
+
+// Render the violation in the Home Connect error format
+func renderViolation(w http.ResponseWriter, v *Violation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": struct {
+			Key string `json:"key"`
+			*Violation
+		}{"Proxy.Error.ConstraintViolation", v},
+	})
+}
@@ -0,0 +1,236 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/mqttpublisher"
+	"github.com/ananchev/homeconnect-proxy/internal/presets"
+	"github.com/ananchev/homeconnect-proxy/internal/scenes"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
+	"github.com/ananchev/homeconnect-proxy/internal/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Action of a rule: an appliance action as in scenes, running a scene, publishing to MQTT or calling a webhook.
+// Appliance actions act on the appliance of the event, unless another appliance is given.
+type Action struct {
+	presets.Action `yaml:",inline"`
+	Scene          string         `yaml:"scene" json:"scene,omitempty"`
+	MQTT           *MQTTAction    `yaml:"mqtt" json:"mqtt,omitempty"`
+	Webhook        *WebhookAction `yaml:"webhook" json:"webhook,omitempty"`
+}
+
+// MQTTAction publishes a message below the root topic of the MQTT sink. The payload is the
+// triggering event if not given.
+type MQTTAction struct {
+	Topic   string `yaml:"topic" json:"topic"`
+	Payload string `yaml:"payload" json:"payload,omitempty"`
+}
+
+// WebhookAction calls a URL, by default with POST and the triggering event as body. The body
+// is signed like the webhook sink does if a secret is given.
+type WebhookAction struct {
+	URL    string `yaml:"url" json:"url"`
+	Method string `yaml:"method" json:"method,omitempty"`
+	Body   string `yaml:"body" json:"body,omitempty"`
+	Secret string `yaml:"secret" json:"-"`
+}
+
+// Firing records the run of a rule
+type Firing struct {
+	Rule    string         `json:"rule"`
+	Time    time.Time      `json:"time"`
+	DryRun  bool           `json:"dry_run,omitempty"`
+	Event   eventbus.Event `json:"event"`
+	Actions []ActionResult `json:"actions"`
+}
+
+// ActionResult is the outcome of a single action of a firing
+type ActionResult struct {
+	Action string `json:"action"`
+	presets.Result
+}
+
+const maxFirings = 100
+
+var (
+	firingsMu sync.Mutex
+	firings   []Firing
+
+	client = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Validate checks the action has exactly one kind of operation
+func (a *Action) Validate() error {
+	applianceAction := a.PresetName != "" || a.Program != "" || a.Setting != "" || a.Command != "" || a.Request != nil
+	kinds := 0
+	for _, k := range []bool{applianceAction, a.Scene != "", a.MQTT != nil, a.Webhook != nil} {
+		if k {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of 'preset', 'program', 'setting', 'command', 'request', 'scene', 'mqtt' or 'webhook' is required")
+	}
+	switch {
+	case applianceAction:
+		pa := a.Action
+		if pa.Appliance == "" {
+			pa.Appliance = "event" // resolved from the event when executed
+		}
+		return pa.Validate()
+	case a.MQTT != nil && a.MQTT.Topic == "":
+		return errors.New("mqtt action has no topic")
+	case a.Webhook != nil && a.Webhook.URL == "":
+		return errors.New("webhook action has no url")
+	}
+	return nil
+}
+
+// Describe returns a short text for logs and reports
+func (a *Action) Describe() string {
+	switch {
+	case a.Scene != "":
+		return "scene " + a.Scene
+	case a.MQTT != nil:
+		return "mqtt " + a.MQTT.Topic
+	case a.Webhook != nil:
+		return "webhook " + a.Webhook.URL
+	}
+	return a.Action.Describe()
+}
+
+// execute the actions of a fired rule one after another, and record the firing
+func execute(r *Rule, ev eventbus.Event, dryRun bool) {
+	f := Firing{Rule: r.Name, Time: time.Now(), DryRun: dryRun, Event: ev}
+	ctx, span := tracing.Start(context.Background(), "Rule "+r.Name,
+		attribute.String("hc.haId", ev.HaID),
+		attribute.String("hc.event", ev.Type),
+		attribute.Bool("rule.dry_run", dryRun),
+	)
+	defer span.End()
+	for i := range r.Actions {
+		a := r.Actions[i]
+		result := ActionResult{Action: a.Describe()}
+		if dryRun {
+			logger.Info("Rule '{rule}' would execute '{action}' (dry-run)", "rule", r.Name, "action", result.Action)
+		} else {
+			logger.Info("Rule '{rule}' executing '{action}'", "rule", r.Name, "action", result.Action)
+			result.Result = a.execute(ctx, ev)
+			if !result.OK() {
+				span.SetStatus(codes.Error, "action '"+result.Action+"' failed")
+				logger.Error("Rule '{rule}' action '{action}' failed: {status} {err}", "rule", r.Name, "action", result.Action, "status", result.Status, "err", result.Error)
+			}
+		}
+		f.Actions = append(f.Actions, result)
+	}
+
+	firingsMu.Lock()
+	defer firingsMu.Unlock()
+	firings = append(firings, f)
+	if len(firings) > maxFirings {
+		firings = firings[len(firings)-maxFirings:]
+	}
+}
+
+func (a Action) execute(ctx context.Context, ev eventbus.Event) presets.Result {
+	switch {
+	case a.Scene != "":
+		report, err := scenes.Run(ctx, a.Scene)
+		if err != nil {
+			return presets.Result{Status: http.StatusNotFound, Error: err.Error()}
+		}
+		body, _ := json.Marshal(report)
+		if !report.OK {
+			return presets.Result{Status: http.StatusBadGateway, Body: body, Error: "scene failed"}
+		}
+		return presets.Result{Status: http.StatusOK, Body: body}
+
+	case a.MQTT != nil:
+		payload := expand(a.MQTT.Payload, ev)
+		if err := mqttpublisher.PublishMessage(ctx, expand(a.MQTT.Topic, ev), []byte(payload)); err != nil {
+			return presets.Result{Status: http.StatusBadGateway, Error: err.Error()}
+		}
+		return presets.Result{Status: http.StatusOK}
+
+	case a.Webhook != nil:
+		return a.Webhook.call(ctx, ev)
+	}
+
+	if a.Appliance == "" {
+		a.Appliance = ev.HaID
+	}
+	return a.Action.Execute(ctx)
+}
+
+func (w *WebhookAction) call(ctx context.Context, ev eventbus.Event) presets.Result {
+	method := strings.ToUpper(w.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	body := []byte(expand(w.Body, ev))
+	req, err := http.NewRequestWithContext(ctx, method, expand(w.URL, ev), bytes.NewReader(body))
+	if err != nil {
+		return presets.Result{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		req.Header.Set(webhook.SignatureHeader, "sha256="+webhook.Sign(w.Secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return presets.Result{Status: http.StatusBadGateway, Error: err.Error()}
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	result := presets.Result{Status: resp.StatusCode}
+	if !result.OK() {
+		result.Error = fmt.Sprintf("webhook responded with %s", resp.Status)
+	}
+	return result
+}
+
+// expand the placeholders {haId}, {alias}, {type}, {key} and {value} with the triggering event
+// and its first item. An empty template expands to the event as JSON.
+func expand(template string, ev eventbus.Event) string {
+	if template == "" {
+		data, _ := json.Marshal(ev)
+		return string(data)
+	}
+	var key, value string
+	if len(ev.Items) > 0 {
+		key = ev.Items[0].Key
+		value = fmt.Sprint(ev.Items[0].Value)
+	}
+	alias := ev.Alias
+	if alias == "" {
+		alias = ev.HaID
+	}
+	return strings.NewReplacer("{haId}", ev.HaID, "{alias}", alias, "{type}", ev.Type, "{key}", key, "{value}", value).Replace(template)
+}
+
+// recentFirings returns the recorded firings, latest first
+func recentFirings() []Firing {
+	firingsMu.Lock()
+	defer firingsMu.Unlock()
+	list := make([]Firing, len(firings))
+	for i, f := range firings {
+		list[len(firings)-1-i] = f
+	}
+	return list
+}
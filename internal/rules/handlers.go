@@ -0,0 +1,98 @@
+package rules
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+)
+
+// ruleStatus is a rule along with its state, as served by '/proxy/rules'
+type ruleStatus struct {
+	*Rule
+	LastFired *time.Time `json:"last_fired,omitempty"`
+	Pending   bool       `json:"pending,omitempty"` // waiting for the debounce to elapse
+}
+
+// Serve the rules, their state and the recent firings upon request to '/proxy/rules'
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	list := make([]ruleStatus, 0, len(current.Rules))
+	for _, rule := range current.Rules {
+		status := ruleStatus{Rule: rule}
+		if s := states[rule.Name]; s != nil {
+			if !s.lastFired.IsZero() {
+				t := s.lastFired
+				status.LastFired = &t
+			}
+			status.Pending = s.timer != nil
+		}
+		list = append(list, status)
+	}
+	dryRun := config.DryRun
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		DryRun  bool         `json:"dry_run"`
+		Rules   []ruleStatus `json:"rules"`
+		Firings []Firing     `json:"firings"`
+	}{dryRun, list, recentFirings()})
+}
+
+// Read the rules file again upon POST to '/proxy/rules/reload'. The current rules are kept if the file is invalid.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	mu.Lock()
+	n := len(current.Rules)
+	mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"rules": n})
+}
+
+// testResult tells for a rule if a test event matches it and what it would do
+type testResult struct {
+	Rule    string   `json:"rule"`
+	Blocked string   `json:"blocked,omitempty"` // why the rule would not run now
+	Actions []string `json:"actions"`
+}
+
+// Evaluate the rules against an event posted to '/proxy/rules/test', without executing any action.
+// The event has the form '{"haId": "oven", "type": "STATUS", "items": [{"key": "...", "value": "..."}]}',
+// the haId can be an alias.
+func testHandler(w http.ResponseWriter, r *http.Request) {
+	var ev eventbus.Event
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ev.HaID = proxy.ResolveAppliance(ev.HaID)
+	ev.Alias = proxy.Alias(ev.HaID)
+	ev.Received = time.Now()
+
+	results := []testResult{}
+	mu.Lock()
+	for _, rule := range current.Rules {
+		if _, ok := rule.Match(ev); !ok {
+			continue
+		}
+		s := states[rule.Name]
+		if s == nil {
+			s = &ruleState{}
+		}
+		result := testResult{Rule: rule.Name, Blocked: rule.blocked(s, ev.Received)}
+		for i := range rule.Actions {
+			result.Actions = append(result.Actions, rule.Actions[i].Describe())
+		}
+		results = append(results, result)
+	}
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
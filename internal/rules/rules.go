@@ -0,0 +1,343 @@
+// Package rules runs automations inside the proxy: when a matching event arrives from
+// Home Connect, the actions of a rule are executed, e.g. switching the hood light on
+// once the oven starts.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+	"github.com/ananchev/homeconnect-proxy/internal/scenes"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the location of the rule definitions and how they are run
+type Config struct {
+	File   string `env:"RULES_FILE" env-upd:"" env-description:"YAML or JSON file with the rule definitions, rules are disabled if the file does not exist" env-default:"data/rules.yml"`
+	DryRun bool   `env:"RULES_DRY_RUN" env-upd:"" env-description:"Only log the actions of matching rules instead of executing them" env-default:"false"`
+	Queue  int    `env:"RULES_QUEUE_SIZE" env-description:"Number of events buffered for the rules engine" env-default:"100"`
+}
+
+// Trigger selects the events a rule reacts to. The value conditions apply to the item with the key.
+type Trigger struct {
+	scenes.Condition `yaml:",inline"`
+	Event            string `yaml:"event" json:"event,omitempty"` // event type: STATUS, EVENT, NOTIFY, CONNECTED, ...
+}
+
+// Window limits a rule to a time of day, and optionally to days of the week. A window
+// with 'from' later than 'to' spans midnight.
+type Window struct {
+	From string   `yaml:"from" json:"from"`
+	To   string   `yaml:"to" json:"to"`
+	Days []string `yaml:"days" json:"days,omitempty"` // mon, tue, ...
+
+	from, to int // minutes since midnight
+}
+
+// Rule executes its actions when a matching event arrives. With a debounce the actions run only once
+// no further matching event arrived for that long, a cooldown is the minimum time between two runs.
+type Rule struct {
+	Name     string        `yaml:"name" json:"name"`
+	When     Trigger       `yaml:"when" json:"when"`
+	Window   *Window       `yaml:"window" json:"window,omitempty"`
+	Debounce time.Duration `yaml:"debounce" json:"debounce,omitempty"`
+	Cooldown time.Duration `yaml:"cooldown" json:"cooldown,omitempty"`
+	DryRun   bool          `yaml:"dry_run" json:"dry_run,omitempty"`
+	Actions  []Action      `yaml:"actions" json:"actions"`
+}
+
+// File is the content of the rules file
+type File struct {
+	Rules []*Rule `yaml:"rules" json:"rules"`
+}
+
+// state of a rule between events, kept across reloads by rule name
+type ruleState struct {
+	timer     *time.Timer
+	pending   eventbus.Event
+	lastFired time.Time
+}
+
+var (
+	config  Config
+	mu      sync.Mutex
+	current File
+	states  = map[string]*ruleState{}
+)
+
+// Init loads the rules file, registers the rule endpoints with the proxy and starts consuming the event bus
+func Init(cfg Config) error {
+	config = cfg
+	proxy.HandleFunc("/proxy/rules", listHandler, "GET")
+	proxy.HandleFunc("/proxy/rules/reload", reloadHandler, "POST")
+	proxy.HandleFunc("/proxy/rules/test", testHandler, "POST")
+	if err := Load(cfg.File); err != nil {
+		return err
+	}
+	if cfg.DryRun {
+		logger.Info("Rules run in dry-run mode, actions are only logged")
+	}
+	go run(eventbus.Subscribe("rules", cfg.Queue, eventbus.DropOldest))
+	return nil
+}
+
+// Reload reads the rules file again
+func Reload() error {
+	mu.Lock()
+	path := config.File
+	mu.Unlock()
+	return Load(path)
+}
+
+// Reconfigure reads and validates the rules file of the configuration, returning the function
+// replacing the current rules and dry-run mode
+func Reconfigure(cfg Config) (func(), error) {
+	f, err := ReadFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		config.File = cfg.File
+		config.DryRun = cfg.DryRun
+		replace(f)
+	}, nil
+}
+
+// Load reads and validates the rules file, replacing the current rules only if it is valid.
+// A missing file leaves no rules defined.
+func Load(path string) error {
+	f, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	replace(f)
+	return nil
+}
+
+// ReadFile reads and validates a rules file without applying it
+func ReadFile(path string) (f File, err error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		logger.Info("No rules file '{path}', rules are disabled", "path", path)
+		err = nil
+	case err != nil:
+	default:
+		// YAML is a superset of JSON, so both are read the same way
+		if err = yaml.Unmarshal(data, &f); err != nil {
+			err = fmt.Errorf("error parsing rules file '%s': %v", path, err)
+			return
+		}
+		if err = f.Validate(); err != nil {
+			err = fmt.Errorf("invalid rules file '%s': %v", path, err)
+			return
+		}
+		logger.Info("Loaded {n} rule(s) from '{path}'", "n", len(f.Rules), "path", path)
+	}
+	return
+}
+
+// replace the current rules. Called with mu locked.
+func replace(f File) {
+	current = f
+	// pending debounced runs belong to the replaced rules
+	names := map[string]bool{}
+	for _, r := range f.Rules {
+		names[r.Name] = true
+	}
+	for name, s := range states {
+		if s.timer != nil {
+			s.timer.Stop()
+			s.timer = nil
+		}
+		if !names[name] {
+			delete(states, name)
+		}
+	}
+}
+
+// Validate checks every rule has a unique name, a valid window and valid actions
+func (f File) Validate() error {
+	names := map[string]bool{}
+	for i, r := range f.Rules {
+		if r == nil || r.Name == "" {
+			return fmt.Errorf("rule %d has no name", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule name '%s' is not unique", r.Name)
+		}
+		names[r.Name] = true
+
+		if r.When.Key == "" && (r.When.Equals != nil || r.When.NotEquals != nil || r.When.In != nil) {
+			return fmt.Errorf("rule '%s': value condition without key", r.Name)
+		}
+		if r.Window != nil {
+			if err := r.Window.parse(); err != nil {
+				return fmt.Errorf("rule '%s': %v", r.Name, err)
+			}
+		}
+		if len(r.Actions) == 0 {
+			return fmt.Errorf("rule '%s' has no actions", r.Name)
+		}
+		for j := range r.Actions {
+			if err := r.Actions[j].Validate(); err != nil {
+				return fmt.Errorf("rule '%s' action %d: %v", r.Name, j+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (w *Window) parse() (err error) {
+	if w.from, err = minutes(w.From); err != nil {
+		return
+	}
+	if w.to, err = minutes(w.To); err != nil {
+		return
+	}
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("unknown day '%s' in window", d)
+		}
+	}
+	return nil
+}
+
+func minutes(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, fmt.Errorf("window time '%s' is not in the format hh:mm", hhmm)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports if the time falls within the window
+func (w *Window) Contains(t time.Time) bool {
+	if len(w.Days) > 0 {
+		day := false
+		for _, d := range w.Days {
+			if weekdays[strings.ToLower(d)] == t.Weekday() {
+				day = true
+			}
+		}
+		if !day {
+			return false
+		}
+	}
+	m := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return m >= w.from && m < w.to
+	}
+	return m >= w.from || m < w.to
+}
+
+// Match reports if the event triggers the rule, and returns it reduced to the items matching the trigger
+func (r *Rule) Match(ev eventbus.Event) (eventbus.Event, bool) {
+	t := r.When
+	if t.Appliance != "" && proxy.ResolveAppliance(t.Appliance) != ev.HaID {
+		return ev, false
+	}
+	if t.Event != "" && !strings.EqualFold(t.Event, ev.Type) {
+		return ev, false
+	}
+	if t.Key == "" {
+		return ev, true
+	}
+	filter := eventbus.Filter{Keys: []string{t.Key}}
+	ev, ok := filter.Match(ev)
+	if !ok {
+		return ev, false
+	}
+	var items []eventbus.Item
+	for _, item := range ev.Items {
+		if t.Condition.Match(item.Value) {
+			items = append(items, item)
+		}
+	}
+	ev.Items = items
+	return ev, len(items) > 0
+}
+
+// blocked returns why a matching rule does not run at the time, or empty if it does
+func (r *Rule) blocked(s *ruleState, now time.Time) string {
+	if r.Window != nil && !r.Window.Contains(now) {
+		return "outside of the time window"
+	}
+	if r.Cooldown > 0 && !s.lastFired.IsZero() && now.Sub(s.lastFired) < r.Cooldown {
+		return "cooling down"
+	}
+	return ""
+}
+
+// consume the events from the bus and trigger the matching rules
+func run(sub *eventbus.Subscription) {
+	for ev := range sub.Events() {
+		mu.Lock()
+		for _, r := range current.Rules {
+			if matched, ok := r.Match(ev); ok {
+				trigger(r, matched)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// trigger a matched rule, right away or once the debounce elapsed. Called with mu locked.
+func trigger(r *Rule, ev eventbus.Event) {
+	s := states[r.Name]
+	if s == nil {
+		s = &ruleState{}
+		states[r.Name] = s
+	}
+	if r.Debounce <= 0 {
+		fire(r, s, ev)
+		return
+	}
+
+	s.pending = ev
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(r.Debounce, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if s.timer != timer { // superseded by a newer event or a reload
+			return
+		}
+		s.timer = nil
+		fire(r, s, s.pending)
+	})
+	s.timer = timer
+}
+
+// fire the actions of the rule unless blocked by its window or cooldown. Called with mu locked.
+func fire(r *Rule, s *ruleState, ev eventbus.Event) {
+	now := time.Now()
+	if reason := r.blocked(s, now); reason != "" {
+		logger.Info("Rule '{rule}' matched, but is {reason}", "rule", r.Name, "reason", reason)
+		return
+	}
+	s.lastFired = now
+
+	dryRun := config.DryRun || r.DryRun
+	// actions may take long, e.g. scenes with delays, so they do not hold up the event stream
+	go execute(r, ev, dryRun)
+}
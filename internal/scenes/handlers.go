@@ -0,0 +1,72 @@
+package scenes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/mqttpublisher"
+	"github.com/gorilla/mux"
+)
+
+// Run a scene upon POST to '/proxy/scenes/{scene}' and respond with its report,
+// status 502 if a step failed and 409 if the scene is already running
+func runHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := Run(r.Context(), mux.Vars(r)["scene"])
+	if errors.Is(err, ErrRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Serve the scene definitions and the report of their last run upon request to '/proxy/scenes'
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	scenes := current.Scenes
+	mu.RUnlock()
+	if scenes == nil {
+		scenes = map[string]*Scene{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Scenes  map[string]*Scene `json:"scenes"`
+		LastRun map[string]Report `json:"last_run"`
+	}{scenes, lastReports()})
+}
+
+// subscribe to '<root>/scenes/<scene>/run' on the MQTT sink, the report of the run
+// is published to '<root>/scenes/<scene>/result'
+func subscribe() {
+	mqttpublisher.Subscribe("scenes/+/run", func(ctx context.Context, topic string, payload []byte) {
+		segments := mqttpublisher.TopicSegments(topic)
+		if len(segments) != 3 {
+			return
+		}
+		name := segments[1]
+		// run outside the MQTT client callback, which must not block
+		go func() {
+			report, err := Run(ctx, name)
+			var result []byte
+			if err != nil {
+				logger.Error("Error running scene from MQTT: {err}", "err", err.Error())
+				result, _ = json.Marshal(map[string]string{"scene": name, "error": err.Error()})
+			} else {
+				result, _ = json.Marshal(report)
+			}
+			if err = mqttpublisher.PublishMessage(ctx, "scenes/"+name+"/result", result); err != nil {
+				logger.Error("Error publishing result of scene '{scene}': {err}", "scene", name, "err", err.Error())
+			}
+		}()
+	})
+}
@@ -0,0 +1,319 @@
+// Package scenes runs named sequences of actions across appliances, e.g. preheating the oven
+// while switching the hood lighting on, with delays and conditions between the steps.
+package scenes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/presets"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/codes"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the location of the scene definitions
+type Config struct {
+	File string `env:"SCENES_FILE" env-description:"YAML or JSON file with the scene definitions, scenes are disabled if the file does not exist" env-default:"data/scenes.yml"`
+}
+
+// Condition on the current value of a status, setting or option of an appliance
+type Condition struct {
+	Appliance string        `yaml:"appliance" json:"appliance,omitempty"` // defaults to the appliance of the step
+	Key       string        `yaml:"key" json:"key"`
+	Equals    interface{}   `yaml:"equals" json:"equals,omitempty"`
+	NotEquals interface{}   `yaml:"not_equals" json:"not_equals,omitempty"`
+	In        []interface{} `yaml:"in" json:"in,omitempty"`
+}
+
+// Step of a scene: an action, optionally delayed and only executed if its condition holds
+type Step struct {
+	presets.Action `yaml:",inline"`
+	Delay          time.Duration `yaml:"delay" json:"delay,omitempty"` // wait before the step
+	When           *Condition    `yaml:"when" json:"when,omitempty"`
+}
+
+// Scene is a named sequence of steps. By default a scene stops at the first failed step.
+type Scene struct {
+	Steps           []Step `yaml:"steps" json:"steps"`
+	ContinueOnError bool   `yaml:"continue_on_error" json:"continue_on_error"`
+}
+
+// File is the content of the scenes file
+type File struct {
+	Scenes map[string]*Scene `yaml:"scenes" json:"scenes"`
+}
+
+// StepResult is the outcome of a single step of a scene run
+type StepResult struct {
+	Step    int    `json:"step"`
+	Action  string `json:"action"`
+	Skipped string `json:"skipped,omitempty"` // reason the step was not executed
+	presets.Result
+}
+
+// Report is the outcome of a scene run
+type Report struct {
+	Scene    string       `json:"scene"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	OK       bool         `json:"ok"`
+	Steps    []StepResult `json:"steps"`
+}
+
+var (
+	mu      sync.RWMutex
+	current File
+	last    = map[string]Report{}
+
+	// names of the scenes being run, a scene is not run again before its run completed
+	running = map[string]bool{}
+)
+
+// ErrRunning is returned when a scene is run while a run of it is in progress
+var ErrRunning = errors.New("scene is already running")
+
+// Init loads the scenes file, registers the scene endpoints with the proxy and subscribes to scene triggers over MQTT
+func Init(cfg Config) error {
+	proxy.HandleFunc("/proxy/scenes", listHandler, "GET")
+	proxy.HandleFunc("/proxy/scenes/{scene}", runHandler, "POST")
+	subscribe()
+	return Load(cfg.File)
+}
+
+// Load reads and validates the scenes file, replacing the current scenes only if it is valid.
+// A missing file leaves no scenes defined.
+func Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			logger.Info("No scenes file '{path}', scenes are disabled", "path", path)
+			err = nil
+		}
+		return err
+	}
+
+	// YAML is a superset of JSON, so both are read the same way
+	var f File
+	if err = yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("error parsing scenes file '%s': %v", path, err)
+	}
+	if err = f.Validate(); err != nil {
+		return fmt.Errorf("invalid scenes file '%s': %v", path, err)
+	}
+
+	mu.Lock()
+	current = f
+	mu.Unlock()
+	logger.Info("Loaded {n} scene(s) from '{path}'", "n", len(f.Scenes), "path", path)
+	return nil
+}
+
+// Validate checks every step of every scene
+func (f File) Validate() error {
+	for name, s := range f.Scenes {
+		if s == nil || len(s.Steps) == 0 {
+			return fmt.Errorf("scene '%s' has no steps", name)
+		}
+		for i, step := range s.Steps {
+			if err := step.Action.Validate(); err != nil {
+				return fmt.Errorf("scene '%s' step %d: %v", name, i+1, err)
+			}
+			if step.When != nil && step.When.Key == "" {
+				return fmt.Errorf("scene '%s' step %d: condition has no key", name, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// Names returns the names of the defined scenes
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(current.Scenes))
+	for name := range current.Scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run executes the scene with the given name step by step, returning the report of the run
+func Run(ctx context.Context, name string) (report Report, err error) {
+	mu.Lock()
+	scene, ok := current.Scenes[name]
+	busy := running[name]
+	if ok && !busy {
+		running[name] = true
+	}
+	mu.Unlock()
+	if !ok {
+		return report, fmt.Errorf("no scene '%s'", name)
+	}
+	if busy {
+		return report, fmt.Errorf("%w: '%s'", ErrRunning, name)
+	}
+	defer func() {
+		mu.Lock()
+		delete(running, name)
+		mu.Unlock()
+	}()
+
+	ctx, span := tracing.Start(ctx, "Scene "+name)
+	defer span.End()
+
+	logger.Info("Running scene '{scene}' with {n} step(s)", "scene", name, "n", len(scene.Steps))
+	report = Report{Scene: name, Started: time.Now(), OK: true}
+	failed := false
+	for i, step := range scene.Steps {
+		result := StepResult{Step: i + 1, Action: step.Describe()}
+		switch {
+		case failed && !scene.ContinueOnError:
+			result.Skipped = "previous step failed"
+		default:
+			if step.Delay > 0 {
+				time.Sleep(step.Delay)
+			}
+			if reason := step.skip(ctx); reason != "" {
+				result.Skipped = reason
+				break
+			}
+			result.Result = step.Execute(ctx)
+			if !result.OK() {
+				failed = true
+				report.OK = false
+				logger.Error("Scene '{scene}' step {step} '{action}' failed: {status} {err}", "scene", name, "step", result.Step, "action", result.Action, "status", result.Status, "err", result.Error)
+			}
+		}
+		report.Steps = append(report.Steps, result)
+	}
+	report.Finished = time.Now()
+	if !report.OK {
+		span.SetStatus(codes.Error, "scene failed")
+	}
+
+	mu.Lock()
+	last[name] = report
+	mu.Unlock()
+	logger.Info("Scene '{scene}' completed, success: {ok}", "scene", name, "ok", report.OK)
+	return report, nil
+}
+
+// skip returns the reason not to execute the step, or empty if its condition holds
+func (s *Step) skip(ctx context.Context) string {
+	if s.When == nil {
+		return ""
+	}
+	appliance := s.When.Appliance
+	if appliance == "" {
+		appliance = s.Appliance
+	}
+	ok, err := s.When.Check(ctx, appliance)
+	if err != nil {
+		return "condition not evaluated: " + err.Error()
+	}
+	if !ok {
+		return "condition on '" + s.When.Key + "' not met"
+	}
+	return ""
+}
+
+// Check evaluates the condition against the current value on the appliance, which is taken from
+// the state cache, or requested from Home Connect if not cached
+func (c *Condition) Check(ctx context.Context, appliance string) (bool, error) {
+	haId := proxy.ResolveAppliance(appliance)
+	value, ok := proxy.StateValue(haId, c.Key)
+	if !ok {
+		var err error
+		if value, err = fetchValue(ctx, haId, c.Key); err != nil {
+			return false, err
+		}
+	}
+	return c.Match(value), nil
+}
+
+// Match reports if the value satisfies the condition
+func (c *Condition) Match(value interface{}) bool {
+	if c.Equals != nil && !equal(value, c.Equals) {
+		return false
+	}
+	if c.NotEquals != nil && equal(value, c.NotEquals) {
+		return false
+	}
+	if c.In != nil {
+		for _, v := range c.In {
+			if equal(value, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// equal compares values from Home Connect JSON with values from YAML, where numbers have different types
+func equal(a, b interface{}) bool {
+	if fa, ok := number(a); ok {
+		fb, ok := number(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// fetchValue requests the value of a status or setting key from Home Connect
+func fetchValue(ctx context.Context, haId string, key string) (interface{}, error) {
+	for _, section := range []string{"status", "settings"} {
+		resp, err := proxy.Call(ctx, http.MethodGet, "/homeappliances/"+haId+"/"+section+"/"+key, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status != http.StatusOK {
+			continue
+		}
+		var item struct {
+			Data struct {
+				Value interface{} `json:"value"`
+			} `json:"data"`
+		}
+		if err = json.Unmarshal(resp.Body, &item); err != nil {
+			return nil, err
+		}
+		return item.Data.Value, nil
+	}
+	return nil, fmt.Errorf("'%s' is neither a status nor a setting of '%s'", key, haId)
+}
+
+// lastReports returns the last run report of each scene
+func lastReports() map[string]Report {
+	mu.RLock()
+	defer mu.RUnlock()
+	reports := make(map[string]Report, len(last))
+	for name, r := range last {
+		reports[name] = r
+	}
+	return reports
+}
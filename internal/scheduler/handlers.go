@@ -0,0 +1,146 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/gorilla/mux"
+)
+
+// Serve all jobs upon GET to '/proxy/schedules'
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	writeJSON(w, http.StatusOK, sorted())
+}
+
+// Serve a single job upon GET to '/proxy/schedules/{id}'
+func getHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	j, ok := jobs[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+// Create a job from the body of a POST to '/proxy/schedules', e.g.
+// '{"name": "night wash", "cron": "0 2 * * *", "appliance": "dishwasher", "preset": "eco"}'
+func createHandler(w http.ResponseWriter, r *http.Request) {
+	j, err := decodeJob(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j.ID = newID()
+	j.Created = time.Now()
+
+	mu.Lock()
+	defer mu.Unlock()
+	jobs[j.ID] = j
+	schedule(j)
+	if err = save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, j)
+}
+
+// Replace the definition of a job with the body of a PUT to '/proxy/schedules/{id}', keeping its runs
+func updateHandler(w http.ResponseWriter, r *http.Request) {
+	def, err := decodeJob(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	j, ok := jobs[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	j.Name, j.Cron, j.At, j.Paused, j.Action = def.Name, def.Cron, def.At, def.Paused, def.Action
+	j.Done = false
+	schedule(j)
+	if err = save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+// Remove a job upon DELETE to '/proxy/schedules/{id}'
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	id := mux.Vars(r)["id"]
+	j, ok := jobs[id]
+	if !ok {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	unschedule(j)
+	delete(jobs, id)
+	if err := save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Run a job right away upon POST to '/proxy/schedules/{id}/run', without changing its schedule
+func runHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	mu.Lock()
+	j, ok := jobs[id]
+	if !ok {
+		mu.Unlock()
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	action := j.Action
+	mu.Unlock()
+
+	run := execute(r.Context(), action)
+	mu.Lock()
+	// the job may have been deleted or replaced while it ran
+	if j, ok = jobs[id]; ok {
+		j.record(run)
+		if err := save(); err != nil {
+			logger.Error("Error saving scheduled jobs: {err}", "err", err.Error())
+		}
+	}
+	mu.Unlock()
+
+	status := http.StatusOK
+	if run.Skipped != "" {
+		status = http.StatusConflict
+	} else if !run.OK() {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, run)
+}
+
+// decodeJob reads and validates a job definition from the request body
+func decodeJob(r *http.Request) (*Job, error) {
+	var j Job
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		return nil, err
+	}
+	if err := j.validate(); err != nil {
+		return nil, err
+	}
+	return &Job{Name: j.Name, Cron: j.Cron, At: j.At, Paused: j.Paused, Action: j.Action}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
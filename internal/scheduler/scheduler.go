@@ -0,0 +1,354 @@
+// Package scheduler starts programs and applies settings at a given time, once or recurring
+// on a cron schedule. Jobs are persisted and survive a restart of the proxy.
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/presets"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+	"github.com/ananchev/homeconnect-proxy/internal/scenes"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Config holds where the jobs are persisted
+type Config struct {
+	File string `env:"SCHEDULES_FILE" env-description:"JSON file the scheduled jobs are persisted in" env-default:"data/schedules.json"`
+}
+
+// Job runs an appliance action on a cron schedule, or once at a given time
+type Job struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Cron   string `json:"cron,omitempty"` // 'minute hour day month weekday', or a descriptor like '@daily'
+	At     string `json:"at,omitempty"`   // RFC 3339 time, or 'hh:mm' for the next occurrence
+	Paused bool   `json:"paused,omitempty"`
+	presets.Action
+
+	Created time.Time  `json:"created"`
+	Next    *time.Time `json:"next,omitempty"`
+	Done    bool       `json:"done,omitempty"` // one-shot job that ran
+	Runs    []Run      `json:"runs,omitempty"` // latest last
+
+	entry cron.EntryID
+	timer *time.Timer
+}
+
+// Run records the outcome of a job run
+type Run struct {
+	Time    time.Time `json:"time"`
+	Skipped string    `json:"skipped,omitempty"`
+	presets.Result
+}
+
+// remote start has to be allowed on the appliance before a program can be started through the API
+const remoteStartKey = "BSH.Common.Status.RemoteControlStartAllowed"
+
+// number of runs kept per job
+const maxRuns = 20
+
+var (
+	config Config
+	mu     sync.Mutex
+	jobs   = map[string]*Job{}
+	runner = cron.New()
+
+	// one-shot timers pending or firing, waited for on shutdown. Counted when scheduled, as the
+	// counter must not go up from zero while Stop waits.
+	timers  sync.WaitGroup
+	stopped bool
+)
+
+// Init loads the persisted jobs, schedules them and registers the schedule endpoints with the proxy
+func Init(cfg Config) error {
+	config = cfg
+	proxy.HandleFunc("/proxy/schedules", listHandler, "GET")
+	proxy.HandleFunc("/proxy/schedules", createHandler, "POST")
+	proxy.HandleFunc("/proxy/schedules/{id}", getHandler, "GET")
+	proxy.HandleFunc("/proxy/schedules/{id}", updateHandler, "PUT")
+	proxy.HandleFunc("/proxy/schedules/{id}", deleteHandler, "DELETE")
+	proxy.HandleFunc("/proxy/schedules/{id}/run", runHandler, "POST")
+
+	if err := load(); err != nil {
+		return err
+	}
+	runner.Start()
+	return nil
+}
+
+// Stop ends the scheduling and waits for the jobs being run to complete, or the context to expire.
+// Pending one-shot jobs stay pending and are scheduled again on the next start.
+func Stop(ctx context.Context) error {
+	mu.Lock()
+	stopped = true
+	for _, j := range jobs {
+		stopTimer(j)
+	}
+	mu.Unlock()
+	cronDone := runner.Stop().Done()
+
+	timersDone := make(chan struct{})
+	go func() {
+		timers.Wait()
+		close(timersDone)
+	}()
+	for _, done := range []<-chan struct{}{cronDone, timersDone} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return errors.New("scheduled jobs still running")
+		}
+	}
+	return nil
+}
+
+// load the persisted jobs and schedule them. One-shot jobs missed while the proxy was not running
+// are recorded as skipped rather than run late.
+func load() error {
+	data, err := ioutil.ReadFile(config.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Job
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("error parsing schedules file '%s': %v", config.File, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, j := range list {
+		if err := j.validate(); err != nil {
+			logger.Error("Ignoring scheduled job '{id}': {err}", "id", j.ID, "err", err.Error())
+			continue
+		}
+		jobs[j.ID] = j
+		if j.At != "" && !j.Done {
+			if at, _ := time.Parse(time.RFC3339, j.At); at.Before(time.Now()) {
+				j.Done = true
+				j.record(Run{Time: time.Now(), Skipped: "missed while the proxy was not running"})
+				continue
+			}
+		}
+		schedule(j)
+	}
+	logger.Info("Loaded {n} scheduled job(s) from '{path}'", "n", len(jobs), "path", config.File)
+	return save()
+}
+
+// validate the job definition, normalizing a one-shot time to RFC 3339
+func (j *Job) validate() error {
+	if (j.Cron == "") == (j.At == "") {
+		return errors.New("exactly one of 'cron' or 'at' is required")
+	}
+	if j.Cron != "" {
+		if _, err := cron.ParseStandard(j.Cron); err != nil {
+			return fmt.Errorf("invalid cron expression '%s': %v", j.Cron, err)
+		}
+	}
+	if j.At != "" {
+		at, err := parseAt(j.At, time.Now())
+		if err != nil {
+			return err
+		}
+		j.At = at.Format(time.RFC3339)
+	}
+	if j.Action.PresetName == "" && j.Program == "" && j.Setting == "" && j.Command == "" && j.Request == nil {
+		return errors.New("no action: one of 'preset', 'program', 'setting', 'command' or 'request' is required")
+	}
+	return j.Action.Validate()
+}
+
+// parseAt reads a time in RFC 3339, or 'hh:mm' as the next occurrence of that time of day
+func parseAt(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	clock, err := time.ParseInLocation("15:04", s, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'at' must be an RFC 3339 time or hh:mm, not '%s'", s)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// schedule the job with the cron runner or a timer. Called with mu locked.
+func schedule(j *Job) {
+	unschedule(j)
+	j.Next = nil
+	if j.Paused || j.Done || stopped {
+		return
+	}
+	id := j.ID
+	if j.Cron != "" {
+		entry, err := runner.AddFunc(j.Cron, func() { fire(id) })
+		if err != nil {
+			logger.Error("Error scheduling job '{id}': {err}", "id", id, "err", err.Error())
+			return
+		}
+		j.entry = entry
+		next := runner.Entry(entry).Schedule.Next(time.Now())
+		j.Next = &next
+		return
+	}
+	at, _ := time.Parse(time.RFC3339, j.At)
+	timers.Add(1)
+	j.timer = time.AfterFunc(time.Until(at), func() {
+		defer timers.Done()
+		fire(id)
+	})
+	j.Next = &at
+}
+
+// unschedule removes the job from the cron runner or stops its timer. Called with mu locked.
+func unschedule(j *Job) {
+	if j.entry != 0 {
+		runner.Remove(j.entry)
+		j.entry = 0
+	}
+	stopTimer(j)
+}
+
+// stopTimer stops the timer of a one-shot job, unless it already fired. Called with mu locked.
+func stopTimer(j *Job) {
+	if j.timer == nil {
+		return
+	}
+	if j.timer.Stop() {
+		timers.Done()
+	}
+	j.timer = nil
+}
+
+// fire runs a scheduled job and records the outcome
+func fire(id string) {
+	mu.Lock()
+	j, ok := jobs[id]
+	if !ok {
+		mu.Unlock()
+		return
+	}
+	action := j.Action
+	name := j.label()
+	mu.Unlock()
+
+	logger.Info("Running scheduled job '{job}': {action} on '{appliance}'", "job", name, "action", action.Describe(), "appliance", action.Appliance)
+	ctx, span := tracing.Start(context.Background(), "Schedule "+name, attribute.String("hc.appliance", action.Appliance))
+	run := execute(ctx, action)
+	span.SetAttributes(attribute.String("schedule.skipped", run.Skipped))
+	if run.Skipped == "" && !run.OK() {
+		span.SetStatus(codes.Error, run.Error)
+	}
+	span.End()
+	if run.Skipped != "" {
+		logger.Info("Scheduled job '{job}' skipped: {reason}", "job", name, "reason", run.Skipped)
+	} else if !run.OK() {
+		logger.Error("Scheduled job '{job}' failed: {status} {err}", "job", name, "status", run.Status, "err", run.Error)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if j, ok = jobs[id]; !ok {
+		return
+	}
+	j.record(run)
+	if j.At != "" {
+		j.Done = true
+		j.timer = nil
+		j.Next = nil
+	} else if j.entry != 0 {
+		next := runner.Entry(j.entry).Schedule.Next(time.Now())
+		j.Next = &next
+	}
+	if err := save(); err != nil {
+		logger.Error("Error saving scheduled jobs: {err}", "err", err.Error())
+	}
+}
+
+// execute the action, unless it starts a program and remote start is not allowed on the appliance
+func execute(ctx context.Context, action presets.Action) Run {
+	run := Run{Time: time.Now()}
+	if action.StartsProgram() {
+		allowed := scenes.Condition{Key: remoteStartKey, Equals: true}
+		ok, err := allowed.Check(ctx, action.Appliance)
+		switch {
+		case err != nil:
+			run.Skipped = "remote start permission unknown: " + err.Error()
+			return run
+		case !ok:
+			run.Skipped = "remote start is not allowed on the appliance"
+			return run
+		}
+	}
+	run.Result = action.Execute(ctx)
+	return run
+}
+
+func (j *Job) record(run Run) {
+	j.Runs = append(j.Runs, run)
+	if len(j.Runs) > maxRuns {
+		j.Runs = j.Runs[len(j.Runs)-maxRuns:]
+	}
+}
+
+func (j *Job) label() string {
+	if j.Name != "" {
+		return j.Name
+	}
+	return j.ID
+}
+
+// sorted returns the jobs ordered by creation. Called with mu locked.
+func sorted() []*Job {
+	list := make([]*Job, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, j)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Created.Before(list[b].Created) })
+	return list
+}
+
+// save writes all jobs to the schedules file, replacing it at once. Called with mu locked.
+func save() error {
+	data, err := json.MarshalIndent(sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(config.File), 0755); err != nil {
+		return err
+	}
+	tmp := config.File + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, config.File)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var errNotFound = errors.New("no such scheduled job")
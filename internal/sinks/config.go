@@ -0,0 +1,108 @@
+package sinks
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ananchev/homeconnect-proxy/internal/config"
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/history"
+	"github.com/ananchev/homeconnect-proxy/internal/mqttpublisher"
+	"github.com/ananchev/homeconnect-proxy/internal/timeseries"
+	"github.com/ananchev/homeconnect-proxy/internal/webhook"
+)
+
+// Config enables the sinks and holds the settings of every sink type.
+// A new sink type adds its settings here and its constructor to build.
+type Config struct {
+	Enabled []string `env:"SINKS" env-description:"Comma separated list of event sinks to enable: mqtt, webhook, tsdb, history" env-default:"mqtt"`
+
+	MQTT        mqttpublisher.Config
+	MQTTOptions Options `env-prefix:"MQTT_"`
+
+	Webhook        webhook.Config
+	WebhookOptions Options `env-prefix:"WEBHOOK_"`
+
+	TimeSeries        timeseries.Config
+	TimeSeriesOptions Options `env-prefix:"TSDB_"`
+
+	History        history.Config
+	HistoryOptions Options `env-prefix:"HISTORY_"`
+}
+
+// sink ready to be started, along with its common options
+type configured struct {
+	sink   EventSink
+	opts   Options
+	policy eventbus.Policy
+}
+
+// section of the configuration belonging to a sink type: its settings, and its options along with
+// the prefix of their keys
+type section struct {
+	name     string
+	settings interface{}
+	opts     Options
+	prefix   string
+}
+
+func sections(cfg *Config) []section {
+	return []section{
+		{"mqtt", &cfg.MQTT, cfg.MQTTOptions, optionsPrefix("MQTTOptions")},
+		{"webhook", &cfg.Webhook, cfg.WebhookOptions, optionsPrefix("WebhookOptions")},
+		{"tsdb", &cfg.TimeSeries, cfg.TimeSeriesOptions, optionsPrefix("TimeSeriesOptions")},
+		{"history", &cfg.History, cfg.HistoryOptions, optionsPrefix("HistoryOptions")},
+	}
+}
+
+// optionsPrefix returns the 'env-prefix' of the options field of Config with the given name
+func optionsPrefix(field string) string {
+	f, _ := reflect.TypeOf(Config{}).FieldByName(field)
+	return f.Tag.Get("env-prefix")
+}
+
+// reloadable returns the keys of the section applied by a reload
+func (s section) reloadable() (keys []string) {
+	settings, _ := config.Fields(s.settings)
+	for _, f := range settings {
+		if f.Reloadable {
+			keys = append(keys, f.Key)
+		}
+	}
+	opts, _ := config.Fields(&s.opts)
+	for _, f := range opts {
+		if f.Reloadable {
+			keys = append(keys, s.prefix+f.Key)
+		}
+	}
+	return
+}
+
+// Create the enabled sinks out of the configuration, checking their common options
+func build(cfg Config) (sinks []configured, err error) {
+	for _, name := range cfg.Enabled {
+		var s configured
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+			continue
+		case "mqtt":
+			s = configured{sink: mqttpublisher.New(cfg.MQTT), opts: cfg.MQTTOptions}
+		case "webhook":
+			s = configured{sink: webhook.New(cfg.Webhook), opts: cfg.WebhookOptions}
+		case "tsdb":
+			s = configured{sink: timeseries.New(cfg.TimeSeries), opts: cfg.TimeSeriesOptions}
+		case "history":
+			s = configured{sink: history.New(cfg.History), opts: cfg.HistoryOptions}
+		default:
+			err = fmt.Errorf("unknown event sink '%s'", name)
+			return
+		}
+		if s.policy, err = eventbus.ParsePolicy(s.opts.Policy); err != nil {
+			err = fmt.Errorf("sink '%s': %v", s.sink.Name(), err)
+			return
+		}
+		sinks = append(sinks, s)
+	}
+	return
+}
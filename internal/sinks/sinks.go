@@ -0,0 +1,283 @@
+// Package sinks runs the configured event outputs, each consuming the event bus on its own.
+package sinks
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/history"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/metrics"
+	"github.com/ananchev/homeconnect-proxy/internal/mqttpublisher"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+	"github.com/ananchev/homeconnect-proxy/internal/webhook"
+)
+
+// EventSink is an output for the events received from Home Connect
+type EventSink interface {
+	// Name identifies the sink in configuration and logs
+	Name() string
+	// Start prepares the sink, before the first event is delivered
+	Start() error
+	// Deliver hands over a single event, already filtered for the sink
+	Deliver(ev eventbus.Event) error
+	// Flush writes out anything the sink has buffered
+	Flush() error
+	// Close flushes and releases the sink resources
+	Close() error
+	// Health returns nil if the sink is able to deliver events
+	Health() error
+}
+
+// Options are the settings every sink has, independent of its type
+type Options struct {
+	HaIDs  []string      `env:"FILTER_HAIDS" env-upd:"" env-description:"Comma separated haIds to pass to the sink, all if empty"`
+	Types  []string      `env:"FILTER_EVENTS" env-upd:"" env-description:"Comma separated event types (STATUS, EVENT, NOTIFY, ...) to pass to the sink, all if empty"`
+	Keys   []string      `env:"FILTER_KEYS" env-upd:"" env-description:"Comma separated item keys to pass to the sink, all if empty. A trailing '*' matches any key with that prefix"`
+	Queue  int           `env:"QUEUE_SIZE" env-description:"Number of events buffered for the sink" env-default:"100"`
+	Policy string        `env:"QUEUE_POLICY" env-description:"What to do when the sink queue is full: drop-oldest, block or disconnect" env-default:"drop-oldest"`
+	Flush  time.Duration `env:"FLUSH_INTERVAL" env-description:"Interval at which the sink is flushed" env-default:"10s"`
+}
+
+// running sink along with its bus subscription
+type runner struct {
+	sink     EventSink
+	opts     Options
+	policy   eventbus.Policy
+	subMu    sync.Mutex
+	sub      *eventbus.Subscription
+	dropped  uint64 // events dropped by the previous subscriptions
+	filterMu sync.Mutex
+	filter   eventbus.Filter
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// delays before a sink disconnected for falling behind is attached to the bus again
+const (
+	minResubscribeDelay = time.Second
+	maxResubscribeDelay = time.Minute
+)
+
+var (
+	mu      sync.Mutex
+	running []*runner
+)
+
+// Start creates every enabled sink, starts it and attaches it to the event bus. All sinks are
+// created and their settings checked before the first one is started.
+func Start(cfg Config) error {
+	sinks, err := build(cfg)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range sinks {
+		logger.Info("Starting event sink '{sink}' ...", "sink", s.sink.Name())
+		if err := s.sink.Start(); err != nil {
+			// the sink may recover later, e.g. when the broker comes up, so keep it running
+			logger.Error("Event sink '{sink}' started with error: '{err}'", "sink", s.sink.Name(), "err", err.Error())
+		}
+		r := &runner{
+			sink:   s.sink,
+			opts:   s.opts,
+			policy: s.policy,
+			filter: eventbus.Filter{HaIDs: s.opts.HaIDs, Types: s.opts.Types, Keys: s.opts.Keys},
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+		r.subscribe()
+		metrics.SinkDropped(s.sink.Name(), r.droppedEvents)
+		registerEndpoints(s.sink)
+		running = append(running, r)
+		go r.run()
+	}
+	return nil
+}
+
+// Stop detaches all sinks from the bus, delivers what they have queued, then flushes and closes them
+func Stop() {
+	mu.Lock()
+	stopping := running
+	running = nil
+	mu.Unlock()
+
+	for _, r := range stopping {
+		close(r.stop)
+		r.subscription().Close()
+		<-r.done
+	}
+}
+
+// Reconfigure checks the new settings of the running sinks and returns the function applying them:
+// the event filters, the MQTT root topic and the webhook settings. Other settings take effect on
+// the next start. Also returns the reloadable keys of the sink types not running, which are not applied.
+func Reconfigure(cfg Config) (apply func(), idle []string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	secs := sections(&cfg)
+	var applies []func()
+	started := map[string]bool{}
+	for _, r := range running {
+		r, name := r, r.sink.Name()
+		started[name] = true
+		for _, sec := range secs {
+			if sec.name == name {
+				filter := eventbus.Filter{HaIDs: sec.opts.HaIDs, Types: sec.opts.Types, Keys: sec.opts.Keys}
+				applies = append(applies, func() {
+					r.filterMu.Lock()
+					r.filter = filter
+					r.filterMu.Unlock()
+				})
+			}
+		}
+
+		switch s := r.sink.(type) {
+		case *mqttpublisher.Publisher:
+			topic := cfg.MQTT.Topic
+			applies = append(applies, func() { s.SetRootTopic(topic) })
+		case *webhook.Sink:
+			applyWebhook, err := s.Reconfigure(cfg.Webhook)
+			if err != nil {
+				return nil, nil, fmt.Errorf("sink '%s': %v", name, err)
+			}
+			applies = append(applies, applyWebhook)
+		}
+	}
+	for _, sec := range secs {
+		if !started[sec.name] {
+			idle = append(idle, sec.reloadable()...)
+		}
+	}
+	return func() {
+		for _, apply := range applies {
+			apply()
+		}
+	}, idle, nil
+}
+
+// registerEndpoints adds the endpoints a sink serves to the proxy
+func registerEndpoints(sink EventSink) {
+	switch s := sink.(type) {
+	case *webhook.Sink:
+		proxy.HandleFunc("/proxy/webhook/replay", s.ReplayHandler, "POST")
+	case *history.Store:
+		proxy.HandleFunc("/proxy/history", s.QueryHandler, "GET")
+	}
+}
+
+// Health returns the health state of every running sink by name
+func Health() map[string]error {
+	mu.Lock()
+	defer mu.Unlock()
+	health := make(map[string]error, len(running))
+	for _, r := range running {
+		health[r.sink.Name()] = r.sink.Health()
+	}
+	return health
+}
+
+// subscribe attaches the sink to the event bus
+func (r *runner) subscribe() {
+	sub := eventbus.Subscribe("sink "+r.sink.Name(), r.opts.Queue, r.policy)
+	r.subMu.Lock()
+	r.sub = sub
+	r.subMu.Unlock()
+}
+
+func (r *runner) subscription() *eventbus.Subscription {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	return r.sub
+}
+
+// droppedEvents returns the number of events the bus dropped for the sink since it was started
+func (r *runner) droppedEvents() uint64 {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	return r.dropped + r.sub.Dropped()
+}
+
+// resubscribe attaches the sink again after the bus disconnected it for falling behind, with a
+// delay doubled on every disconnect soon after the previous one. Returns false if the sink is being stopped.
+func (r *runner) resubscribe(delay *time.Duration) bool {
+	logger.Error("Event sink '{sink}' was disconnected from the event bus, attaching it again in {delay}", "sink", r.sink.Name(), "delay", *delay)
+	select {
+	case <-r.stop:
+		return false
+	case <-time.After(*delay):
+	}
+	if *delay *= 2; *delay > maxResubscribeDelay {
+		*delay = maxResubscribeDelay
+	}
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	select {
+	case <-r.stop:
+		return false
+	default:
+	}
+	r.dropped += r.sub.Dropped()
+	r.sub = eventbus.Subscribe("sink "+r.sink.Name(), r.opts.Queue, r.policy)
+	return true
+}
+
+func (r *runner) run() {
+	defer close(r.done)
+	name := r.sink.Name()
+
+	var tick <-chan time.Time
+	if r.opts.Flush > 0 {
+		ticker := time.NewTicker(r.opts.Flush)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	delay := minResubscribeDelay
+	attached := time.Now()
+	sub := r.subscription()
+	for {
+		select {
+		case ev, open := <-sub.Events():
+			if !open {
+				select {
+				case <-r.stop:
+				default:
+					if time.Since(attached) > maxResubscribeDelay {
+						delay = minResubscribeDelay
+					}
+					if r.resubscribe(&delay) {
+						attached = time.Now()
+						sub = r.subscription()
+						continue
+					}
+				}
+				if err := r.sink.Close(); err != nil {
+					logger.Error("Error closing event sink '{sink}': '{err}'", "sink", name, "err", err.Error())
+				}
+				logger.Info("Event sink '{sink}' stopped", "sink", name)
+				return
+			}
+			r.filterMu.Lock()
+			filter := r.filter
+			r.filterMu.Unlock()
+			ev, ok := filter.Match(ev)
+			if !ok {
+				continue
+			}
+			err := r.sink.Deliver(ev)
+			if err != nil {
+				logger.Error("Event sink '{sink}' failed to deliver '{type}' event for '{haId}': '{err}'", "sink", name, "type", ev.Type, "haId", ev.HaID, "err", err.Error())
+			}
+			metrics.SinkDelivered(name, err, len(sub.Events()))
+		case <-tick:
+			if err := r.sink.Flush(); err != nil {
+				logger.Error("Error flushing event sink '{sink}': '{err}'", "sink", name, "err", err.Error())
+			}
+		}
+	}
+}
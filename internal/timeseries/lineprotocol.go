@@ -0,0 +1,50 @@
+package timeseries
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// Encode the points in InfluxDB line protocol, with nanosecond timestamps
+func encodeLineProtocol(points []Point) []byte {
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.WriteString(measurementEscaper.Replace(p.Measurement))
+		for _, k := range sortedKeys(p.Tags) {
+			if p.Tags[k] == "" {
+				continue
+			}
+			buf.WriteByte(',')
+			buf.WriteString(tagEscaper.Replace(k))
+			buf.WriteByte('=')
+			buf.WriteString(tagEscaper.Replace(p.Tags[k]))
+		}
+		buf.WriteString(" value=")
+		switch v := p.Value.(type) {
+		case bool:
+			buf.WriteString(strconv.FormatBool(v))
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(p.Time.UnixNano(), 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,90 @@
+package timeseries
+
+import (
+	"math"
+	"sort"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// label names of the remote write series
+var remoteWriteLabels = map[string]string{
+	"haId": "ha_id",
+	"type": "appliance_type",
+	"unit": "unit",
+}
+
+// Encode the points as snappy compressed Prometheus remote write request.
+// The WriteRequest message is small enough to be written field by field:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeRemoteWrite(points []Point) []byte {
+	var req []byte
+	for _, p := range points {
+		labels := map[string]string{"__name__": metricName(p.Measurement)}
+		for k, v := range p.Tags {
+			if name, ok := remoteWriteLabels[k]; ok && v != "" {
+				labels[name] = v
+			}
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var series []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, labels[name])
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, float64bits(p.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(p.Time.UnixNano()/1e6))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return snappy.Encode(nil, req)
+}
+
+// Convert the item key into a valid Prometheus metric name
+func metricName(key string) string {
+	name := []byte(key)
+	for i, c := range name {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// Samples are doubles, booleans are written as 0 and 1
+func float64bits(v interface{}) uint64 {
+	switch v := v.(type) {
+	case float64:
+		return math.Float64bits(v)
+	case bool:
+		if v {
+			return math.Float64bits(1)
+		}
+	}
+	return math.Float64bits(0)
+}
@@ -0,0 +1,236 @@
+// Package timeseries implements the event sink writing numeric and boolean
+// appliance items as time-series points, in InfluxDB line protocol or as Prometheus remote write.
+package timeseries
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+const (
+	formatInflux      = "influx"
+	formatRemoteWrite = "remote-write"
+
+	// points kept while the target is unavailable, the oldest are dropped beyond that
+	maxBuffered = 10000
+)
+
+// event types carrying appliance items
+var pointEvents = map[string]bool{
+	"STATUS": true,
+	"EVENT":  true,
+	"NOTIFY": true,
+}
+
+// Config holds the time-series sink settings
+type Config struct {
+	Format    string        `env:"TSDB_FORMAT" env-description:"Write format: influx (line protocol) or remote-write (Prometheus)" env-default:"influx"`
+	URL       string        `env:"TSDB_URL" env-description:"HTTP endpoint the points are written to, e.g. http://influxdb:8086/api/v2/write?org=home&bucket=appliances"`
+	Token     string        `env:"TSDB_TOKEN" env-description:"Token sent in the Authorization header, 'Token <token>' for influx and 'Bearer <token>' for remote-write"`
+	File      string        `env:"TSDB_FILE" env-description:"Local file the line protocol is appended to instead of an HTTP endpoint (influx format only)"`
+	BatchSize int           `env:"TSDB_BATCH_SIZE" env-description:"Number of points which triggers a write before the flush interval" env-default:"500"`
+	Timeout   time.Duration `env:"TSDB_TIMEOUT" env-description:"Timeout of a single write request" env-default:"10s"`
+}
+
+// Point is a single value of an appliance item
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Value       interface{} // float64 or bool
+	Time        time.Time
+}
+
+// Sink collects the points and writes them in batches
+type Sink struct {
+	cfg    Config
+	client *http.Client
+
+	mu      sync.Mutex
+	points  []Point
+	lastErr error
+}
+
+// New creates the time-series sink
+func New(cfg Config) *Sink {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	return &Sink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+func (s *Sink) Name() string {
+	return "tsdb"
+}
+
+func (s *Sink) Start() error {
+	switch s.cfg.Format {
+	case formatInflux:
+		if s.cfg.URL == "" && s.cfg.File == "" {
+			return errors.New("either TSDB_URL or TSDB_FILE is required")
+		}
+	case formatRemoteWrite:
+		if s.cfg.URL == "" {
+			return errors.New("TSDB_URL is required for remote-write")
+		}
+	default:
+		return fmt.Errorf("unknown time-series format '%s'", s.cfg.Format)
+	}
+	logger.Info("Time-series sink writing '{format}' to '{target}'", "format", s.cfg.Format, "target", s.target())
+	return nil
+}
+
+// Deliver converts the event items into points, writing them once a batch is full
+func (s *Sink) Deliver(ev eventbus.Event) error {
+	points := Points(ev)
+	if len(points) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.points = append(s.points, points...)
+	full := len(s.points) >= s.cfg.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush writes all collected points. On failure the points are kept for the next attempt.
+func (s *Sink) Flush() (err error) {
+	s.mu.Lock()
+	points := s.points
+	s.points = nil
+	s.mu.Unlock()
+
+	if len(points) == 0 {
+		return
+	}
+
+	if s.cfg.Format == formatRemoteWrite {
+		err = s.post(encodeRemoteWrite(points), "application/x-protobuf", "Bearer ")
+	} else {
+		body := encodeLineProtocol(points)
+		if s.cfg.File != "" {
+			err = appendFile(s.cfg.File, body)
+		} else {
+			err = s.post(body, "text/plain; charset=utf-8", "Token ")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	if err != nil {
+		// put the points back in front of the ones collected meanwhile
+		s.points = append(points, s.points...)
+		if dropped := len(s.points) - maxBuffered; dropped > 0 {
+			s.points = s.points[dropped:]
+			logger.Error("Time-series buffer full, dropped {n} point(s)", "n", dropped)
+		}
+	}
+	return
+}
+
+func (s *Sink) Close() error {
+	return s.Flush()
+}
+
+// Health reports the error of the last write, if it failed
+func (s *Sink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+func (s *Sink) target() string {
+	if s.cfg.File != "" && s.cfg.Format == formatInflux {
+		return s.cfg.File
+	}
+	return s.cfg.URL
+}
+
+func (s *Sink) post(body []byte, contentType string, authScheme string) error {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.cfg.Format == formatRemoteWrite {
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	}
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", authScheme+s.cfg.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("time-series write responded with %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Points converts the numeric and boolean items of STATUS, EVENT and NOTIFY events into points,
+// one measurement per item key, tagged with haId, appliance type and unit
+func Points(ev eventbus.Event) (points []Point) {
+	if !pointEvents[ev.Type] {
+		return
+	}
+	for _, item := range ev.Items {
+		var value interface{}
+		switch v := item.Value.(type) {
+		case float64, bool:
+			value = v
+		default:
+			continue
+		}
+
+		tags := map[string]string{"haId": ev.HaID}
+		if ev.ApplianceType != "" {
+			tags["type"] = ev.ApplianceType
+		}
+		if item.Unit != "" {
+			tags["unit"] = item.Unit
+		}
+
+		ts := ev.Received
+		if item.Timestamp > 0 {
+			ts = time.Unix(item.Timestamp, 0)
+		}
+		points = append(points, Point{Measurement: item.Key, Tags: tags, Value: value, Time: ts})
+	}
+	return
+}
@@ -0,0 +1,216 @@
+package timeseries_test
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/timeseries"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// target is a stand-in for InfluxDB or a Prometheus remote write receiver, recording the write requests
+type target struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	status   []int // status of the requests in order, 204 once exhausted
+}
+
+func (t *target) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests = append(t.requests, r)
+	t.bodies = append(t.bodies, body)
+	status := http.StatusNoContent
+	if len(t.status) > 0 {
+		status, t.status = t.status[0], t.status[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func start(t *testing.T, format string, tgt *target) *timeseries.Sink {
+	t.Helper()
+	srv := httptest.NewServer(tgt)
+	t.Cleanup(srv.Close)
+	sink := timeseries.New(timeseries.Config{Format: format, URL: srv.URL, Token: "secret", BatchSize: 100, Timeout: time.Second})
+	if err := sink.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+// event with a number with unit, a boolean and a string item, of which only the first two are points
+var event = eventbus.Event{
+	HaID:          "SIEMENS-HCS01OVN1-1234",
+	ApplianceType: "Oven",
+	Type:          "STATUS",
+	Received:      time.Unix(1700000000, 0),
+	Items: []eventbus.Item{
+		{Key: "Cooking.Oven.Status.CurrentCavityTemperature", Value: 180.5, Unit: "°C", Timestamp: 1700000001},
+		{Key: "BSH.Common.Status.DoorState Open", Value: true},
+		{Key: "BSH.Common.Status.OperationState", Value: "BSH.Common.EnumType.OperationState.Run"},
+	},
+}
+
+func TestLineProtocol(t *testing.T) {
+	tgt := &target{}
+	sink := start(t, "influx", tgt)
+	if err := sink.Deliver(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(tgt.requests))
+	}
+	r := tgt.requests[0]
+	if got := r.Header.Get("Authorization"); got != "Token secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+	if got := r.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	want := "Cooking.Oven.Status.CurrentCavityTemperature,haId=SIEMENS-HCS01OVN1-1234,type=Oven,unit=°C value=180.5 1700000001000000000\n" +
+		`BSH.Common.Status.DoorState\ Open,haId=SIEMENS-HCS01OVN1-1234,type=Oven value=true 1700000000000000000` + "\n"
+	if got := string(tgt.bodies[0]); got != want {
+		t.Errorf("body =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// series is a decoded remote write time series
+type series struct {
+	labels map[string]string
+	value  float64
+	millis int64
+}
+
+// decodeRemoteWrite reads the snappy compressed WriteRequest message
+func decodeRemoteWrite(t *testing.T, body []byte) (list []series) {
+	t.Helper()
+	msg, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := func(b []byte, f func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			if n = f(num, typ, b); n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	fields(msg, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		s := series{labels: map[string]string{}}
+		fields(ts, func(num protowire.Number, _ protowire.Type, b []byte) int {
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case 1: // label
+				var name string
+				fields(v, func(num protowire.Number, _ protowire.Type, b []byte) int {
+					str, n := protowire.ConsumeString(b)
+					if num == 1 {
+						name = str
+					} else {
+						s.labels[name] = str
+					}
+					return n
+				})
+			case 2: // sample
+				fields(v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num == 1 {
+						bits, n := protowire.ConsumeFixed64(b)
+						s.value = math.Float64frombits(bits)
+						return n
+					}
+					millis, n := protowire.ConsumeVarint(b)
+					s.millis = int64(millis)
+					return n
+				})
+			}
+			return n
+		})
+		list = append(list, s)
+		return n
+	})
+	return
+}
+
+func TestRemoteWrite(t *testing.T) {
+	tgt := &target{}
+	sink := start(t, "remote-write", tgt)
+	if err := sink.Deliver(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(tgt.requests))
+	}
+	r := tgt.requests[0]
+	for header, want := range map[string]string{
+		"Authorization":                     "Bearer secret",
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := r.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	want := []series{
+		{
+			labels: map[string]string{"__name__": "Cooking_Oven_Status_CurrentCavityTemperature", "ha_id": "SIEMENS-HCS01OVN1-1234", "appliance_type": "Oven", "unit": "°C"},
+			value:  180.5,
+			millis: 1700000001000,
+		},
+		{
+			labels: map[string]string{"__name__": "BSH_Common_Status_DoorState_Open", "ha_id": "SIEMENS-HCS01OVN1-1234", "appliance_type": "Oven"},
+			value:  1,
+			millis: 1700000000000,
+		},
+	}
+	if got := decodeRemoteWrite(t, tgt.bodies[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %+v\nwant %+v", got, want)
+	}
+}
+
+func TestFailedWriteIsRetried(t *testing.T) {
+	tgt := &target{status: []int{http.StatusServiceUnavailable}}
+	sink := start(t, "influx", tgt)
+	sink.Deliver(event)
+	if err := sink.Flush(); err == nil {
+		t.Fatal("Flush succeeded against an unavailable target")
+	}
+	if sink.Health() == nil {
+		t.Error("Health is nil after a failed write")
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if sink.Health() != nil {
+		t.Errorf("Health = %v after a successful write", sink.Health())
+	}
+	if len(tgt.bodies) != 2 || string(tgt.bodies[0]) != string(tgt.bodies[1]) {
+		t.Errorf("the points of the failed write were not written again: %q", tgt.bodies)
+	}
+}
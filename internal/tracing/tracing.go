@@ -0,0 +1,111 @@
+// Package tracing records OpenTelemetry spans of the proxy requests, token refreshes,
+// the event stream and MQTT messages, and exports them to an OTLP collector.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config defines if and where the traces are exported
+type Config struct {
+	Enabled     bool    `env:"TRACING" env-description:"Export OpenTelemetry traces via OTLP/HTTP" env-default:"false"`
+	Endpoint    string  `env:"TRACING_ENDPOINT" env-description:"Host and port of the OTLP/HTTP collector" env-default:"localhost:4318"`
+	URLPath     string  `env:"TRACING_URL_PATH" env-description:"Path the traces are POSTed to on the collector" env-default:"/v1/traces"`
+	Insecure    bool    `env:"TRACING_INSECURE" env-description:"Send the traces over plain HTTP instead of HTTPS" env-default:"true"`
+	SampleRatio float64 `env:"TRACING_SAMPLE_RATIO" env-description:"Share of the traces started by the proxy that are recorded, from 0 to 1. Incoming traces follow the sampling decision of the caller." env-default:"1"`
+	ServiceName string  `env:"TRACING_SERVICE_NAME" env-description:"Service name the spans are reported under" env-default:"homeconnect-proxy"`
+}
+
+const instrumentation = "github.com/ananchev/homeconnect-proxy"
+
+var provider *sdktrace.TracerProvider
+
+// Init sets up the export of the spans. Without tracing enabled the spans are not recorded,
+// but the W3C trace context is still taken over from incoming requests.
+func Init(cfg Config, version string) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return errors.New("TRACING_SAMPLE_RATIO must be between 0 and 1")
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(cfg.Endpoint),
+		otlptracehttp.WithURLPath(cfg.URLPath),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	// the exporter connects lazily, so an unreachable collector does not fail here
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(cfg.ServiceName),
+			semconv.ServiceVersionKey.String(version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("Error exporting traces: '{err}'", "err", err.Error())
+	}))
+	logger.Info("Exporting traces to '{endpoint}'", "endpoint", cfg.Endpoint+cfg.URLPath)
+	return nil
+}
+
+// Shutdown exports the spans still pending and stops the exporter
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Start begins a span as child of the span in the context, if there is one
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer begins the span of a request served by the proxy, continuing the trace in its 'traceparent' header
+func StartServer(r *http.Request, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// End finishes the span, marking it failed if there is an error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace in the context, or empty if there is none
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
@@ -0,0 +1,141 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is a stand-in for an OTLP/HTTP collector, recording the exported spans
+type collector struct {
+	mu      sync.Mutex
+	paths   []string
+	service []string
+	spans   []*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var req collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, r.URL.Path)
+	for _, rs := range req.ResourceSpans {
+		for _, attr := range rs.Resource.GetAttributes() {
+			if attr.Key == "service.name" {
+				c.service = append(c.service, attr.Value.GetStringValue())
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	resp, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Write(resp)
+}
+
+func (c *collector) span(name string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+const (
+	traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpanID = "00f067aa0ba902b7"
+)
+
+func TestExportAndPropagation(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	// only continued traces are recorded with a sample ratio of 0
+	err := tracing.Init(tracing.Config{
+		Enabled:     true,
+		Endpoint:    strings.TrimPrefix(srv.URL, "http://"),
+		URLPath:     "/v1/traces",
+		Insecure:    true,
+		SampleRatio: 0,
+		ServiceName: "proxy-test",
+	}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/homeappliances", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	ctx, span := tracing.StartServer(r, "GET /homeappliances")
+	if got := tracing.TraceID(ctx); got != traceID {
+		t.Errorf("TraceID = %q, want the trace ID of the traceparent header %q", got, traceID)
+	}
+	_, child := tracing.Start(ctx, "Home Connect GET")
+	tracing.End(child, nil)
+	tracing.End(span, nil)
+
+	_, root := tracing.Start(context.Background(), "Schedule night wash")
+	tracing.End(root, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracing.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.paths) == 0 || c.paths[0] != "/v1/traces" {
+		t.Fatalf("spans exported to %q, want '/v1/traces'", c.paths)
+	}
+	if len(c.service) == 0 || c.service[0] != "proxy-test" {
+		t.Errorf("service.name = %q, want 'proxy-test'", c.service)
+	}
+
+	server := c.span("GET /homeappliances")
+	if server == nil {
+		t.Fatalf("server span not exported, got %v", c.spans)
+	}
+	if got := hex.EncodeToString(server.TraceId); got != traceID {
+		t.Errorf("server span trace ID = %s, want %s", got, traceID)
+	}
+	if got := hex.EncodeToString(server.ParentSpanId); got != parentSpanID {
+		t.Errorf("server span parent = %s, want %s", got, parentSpanID)
+	}
+	if server.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Errorf("server span kind = %v", server.Kind)
+	}
+
+	upstream := c.span("Home Connect GET")
+	if upstream == nil {
+		t.Fatal("child span not exported")
+	}
+	if got := hex.EncodeToString(upstream.TraceId); got != traceID {
+		t.Errorf("child span trace ID = %s, want %s", got, traceID)
+	}
+	if string(upstream.ParentSpanId) != string(server.SpanId) {
+		t.Errorf("child span parent = %x, want the server span %x", upstream.ParentSpanId, server.SpanId)
+	}
+
+	if c.span("Schedule night wash") != nil {
+		t.Error("span of a trace started by the proxy exported with a sample ratio of 0")
+	}
+}
@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// Append the undeliverable events to the dead-letter file, one JSON line per event
+func (s *Sink) deadLetter(url string, events []eventbus.Event, cause error) {
+	entries := make([]DeadLetter, len(events))
+	for i, ev := range events {
+		entries[i] = DeadLetter{URL: url, Event: ev, Error: cause.Error(), FailedAt: time.Now()}
+	}
+	s.appendDeadLetters(entries)
+}
+
+func (s *Sink) appendDeadLetters(entries []DeadLetter) {
+	s.dlMu.Lock()
+	defer s.dlMu.Unlock()
+
+	cfg, _ := s.settings()
+	f, err := os.OpenFile(cfg.DeadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("Error opening webhook dead-letter file: '{err}'", "err", err.Error())
+		return
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, dl := range entries {
+		if err := enc.Encode(dl); err != nil {
+			logger.Error("Error writing webhook dead-letter file: '{err}'", "err", err.Error())
+			return
+		}
+	}
+}
+
+// takeDeadLetters reads the entries of the dead-letter file and empties it
+func (s *Sink) takeDeadLetters() (entries []DeadLetter, err error) {
+	s.dlMu.Lock()
+	defer s.dlMu.Unlock()
+
+	cfg, _ := s.settings()
+	f, err := os.Open(cfg.DeadLetter)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			logger.Error("Skipping invalid webhook dead-letter entry: '{err}'", "err", err.Error())
+			continue
+		}
+		entries = append(entries, dl)
+	}
+	f.Close()
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	err = os.Truncate(cfg.DeadLetter, 0)
+	return
+}
+
+// Replay redelivers every entry of the dead-letter file to its URL. Entries failing again
+// are appended to the file again, with the new error. The file is only locked while taking
+// the entries out and putting the failed ones back, so live deliveries are not held up.
+func (s *Sink) Replay() (replayed int, failed int, err error) {
+	entries, err := s.takeDeadLetters()
+	if err != nil || len(entries) == 0 {
+		return
+	}
+
+	var remaining []DeadLetter
+	for _, dl := range entries {
+		if sendErr := s.send(dl.URL, []eventbus.Event{dl.Event}); sendErr != nil {
+			dl.Error = sendErr.Error()
+			dl.FailedAt = time.Now()
+			remaining = append(remaining, dl)
+			failed++
+			continue
+		}
+		replayed++
+	}
+	if len(remaining) > 0 {
+		s.appendDeadLetters(remaining)
+	}
+	logger.Info("Replayed {replayed} webhook dead-letter event(s), {failed} failed again", "replayed", replayed, "failed", failed)
+	return
+}
+
+// ReplayHandler replays the dead-letter file upon POST to '/proxy/webhook/replay'
+func (s *Sink) ReplayHandler(w http.ResponseWriter, r *http.Request) {
+	replayed, failed, err := s.Replay()
+	if err != nil {
+		logger.Error("Error replaying webhook dead-letter file: '{err}'", "err", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"replayed": replayed, "failed": failed})
+}
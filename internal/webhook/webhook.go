@@ -0,0 +1,227 @@
+// Package webhook implements the event sink POSTing events as JSON to HTTP callbacks.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ananchev/homeconnect-proxy/internal/eventbus"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+)
+
+// SignatureHeader carries the hex encoded HMAC-SHA256 of the request body, prefixed with 'sha256='
+const SignatureHeader = "X-HC-Proxy-Signature"
+
+// Config holds the webhook sink settings
+type Config struct {
+	URLs       []string      `env:"WEBHOOK_URLS" env-upd:"" env-description:"Comma separated URLs the events are POSTed to"`
+	Secret     string        `env:"WEBHOOK_SECRET" env-upd:"" env-description:"Key for the HMAC-SHA256 signature of the request body, no signature if empty"`
+	BatchSize  int           `env:"WEBHOOK_BATCH_SIZE" env-upd:"" env-description:"Number of events sent in a single request, batches are sent as JSON array" env-default:"1"`
+	Retries    int           `env:"WEBHOOK_RETRIES" env-upd:"" env-description:"Number of retries of a failed delivery" env-default:"5"`
+	Backoff    time.Duration `env:"WEBHOOK_BACKOFF" env-upd:"" env-description:"Delay before the first retry, doubled for every next one" env-default:"1s"`
+	Timeout    time.Duration `env:"WEBHOOK_TIMEOUT" env-upd:"" env-description:"Timeout of a single webhook request" env-default:"10s"`
+	DeadLetter string        `env:"WEBHOOK_DEAD_LETTER" env-upd:"" env-description:"JSONL file to which undeliverable events are written" env-default:"data/webhook-dead-letter.jsonl"`
+}
+
+// DeadLetter is a single entry of the dead-letter file
+type DeadLetter struct {
+	URL      string         `json:"url"`
+	Event    eventbus.Event `json:"event"`
+	Error    string         `json:"error"`
+	FailedAt time.Time      `json:"failed_at"`
+}
+
+// Sink POSTs the events to the configured URLs
+type Sink struct {
+	// settings, replaced on reconfiguration
+	cfgMu  sync.RWMutex
+	cfg    Config
+	client *http.Client
+
+	mu      sync.Mutex
+	batch   []eventbus.Event
+	lastErr error
+
+	// guards the dead-letter file
+	dlMu sync.Mutex
+}
+
+// New creates the webhook sink
+func New(cfg Config) *Sink {
+	s := &Sink{}
+	s.set(cfg)
+	return s
+}
+
+// check the settings, as required to start the sink
+func (c Config) check() error {
+	if len(c.URLs) == 0 {
+		return errors.New("no webhook URLs configured")
+	}
+	return nil
+}
+
+// Reconfigure checks new settings for the running sink and returns the function replacing the
+// current ones, they apply from the next delivery on
+func (s *Sink) Reconfigure(cfg Config) (func(), error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	return func() { s.set(cfg) }, nil
+}
+
+func (s *Sink) set(cfg Config) {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+	s.cfg = cfg
+	s.client = &http.Client{Timeout: cfg.Timeout}
+}
+
+// settings returns the current settings and the client configured with them
+func (s *Sink) settings() (Config, *http.Client) {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg, s.client
+}
+
+func (s *Sink) Name() string {
+	return "webhook"
+}
+
+func (s *Sink) Start() error {
+	cfg, _ := s.settings()
+	if err := cfg.check(); err != nil {
+		return err
+	}
+	logger.Info("Webhook sink delivering to {urls}", "urls", cfg.URLs)
+	return nil
+}
+
+// Deliver adds the event to the current batch, which is sent once full
+func (s *Sink) Deliver(ev eventbus.Event) error {
+	cfg, _ := s.settings()
+	s.mu.Lock()
+	s.batch = append(s.batch, ev)
+	full := len(s.batch) >= cfg.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush sends the pending batch to all URLs
+func (s *Sink) Flush() error {
+	s.mu.Lock()
+	batch := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	cfg, _ := s.settings()
+	var firstErr error
+	for _, url := range cfg.URLs {
+		err := s.send(url, batch)
+		if err != nil {
+			logger.Error("Webhook delivery to '{url}' failed, writing {n} event(s) to dead-letter file: '{err}'", "url", url, "n", len(batch), "err", err.Error())
+			s.deadLetter(url, batch, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.lastErr = firstErr
+	s.mu.Unlock()
+	return firstErr
+}
+
+func (s *Sink) Close() error {
+	return s.Flush()
+}
+
+// Health reports the error of the last failed delivery, if the last delivery did not succeed
+func (s *Sink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+// Send the events to the url, retrying with backoff on network errors, 429 and 5xx responses
+func (s *Sink) send(url string, events []eventbus.Event) (err error) {
+	cfg, _ := s.settings()
+	var body []byte
+	if cfg.BatchSize == 1 && len(events) == 1 {
+		body, err = json.Marshal(events[0])
+	} else {
+		body, err = json.Marshal(events)
+	}
+	if err != nil {
+		return
+	}
+
+	delay := cfg.Backoff
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = s.post(url, body)
+		if err == nil || !retry || attempt >= cfg.Retries {
+			return
+		}
+		logger.Info("Webhook delivery to '{url}' failed, retrying in {delay}: '{err}'", "url", url, "delay", delay, "err", err.Error())
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Perform a single POST, returns if a failure is worth retrying
+func (s *Sink) post(url string, body []byte) (retry bool, err error) {
+	cfg, client := s.settings()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(cfg.Secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		retry = true
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	err = fmt.Errorf("webhook responded with %s", resp.Status)
+	return
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -1,13 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/ananchev/homeconnect-proxy/internal/config"
 	"github.com/ananchev/homeconnect-proxy/internal/logger"
-	"github.com/ananchev/homeconnect-proxy/internal/mqttpublisher"
+	"github.com/ananchev/homeconnect-proxy/internal/presets"
 	"github.com/ananchev/homeconnect-proxy/internal/proxy"
-	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/ananchev/homeconnect-proxy/internal/rules"
+	"github.com/ananchev/homeconnect-proxy/internal/scenes"
+	"github.com/ananchev/homeconnect-proxy/internal/scheduler"
+	"github.com/ananchev/homeconnect-proxy/internal/sinks"
+	"github.com/ananchev/homeconnect-proxy/internal/tracing"
 )
 
 // Config is the application configuration structure
@@ -19,55 +32,222 @@ type Config struct {
 	}
 
 	Server struct {
-		Host string `env:"HOST" env-description:"Server host" env-default:"localhost"`
-		Port string `env:"PORT" env-description:"Server port" env-default:"8088"`
+		Host            string        `env:"HOST" env-description:"Server host" env-default:"localhost"`
+		Port            string        `env:"PORT" env-description:"Server port" env-default:"8088"`
+		ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" env-description:"Time given to requests in progress and the event sinks to complete on shutdown" env-default:"15s"`
 	}
 
-	MQTT struct {
-		Host  string `env:"MQTT_HOST" env-description:"MQTT Server host" env-default:"localhost"`
-		Port  string `env:"MQTT_PORT" env-description:"MQTT Server port" env-default:"1883"`
-		Topic string `env:"MQTT_TOPIC" env-description:"MQTT Topic under which to publish event data" env-default:"hc-proxy"`
-	}
+	Proxy proxy.Config
+
+	Log logger.Config
+
+	Tracing tracing.Config
+
+	Presets presets.Config
+
+	Scenes scenes.Config
+
+	Rules rules.Config
+
+	Scheduler scheduler.Config
+
+	Sinks sinks.Config
 }
 
+// version of the build, set with '-ldflags "-X main.version=<version>"'
+var version = "dev"
+
+// exit codes of the application
+const (
+	exitOK      = 0
+	exitFailure = 1 // the server failed, or the shutdown did not complete in time
+	exitConfig  = 2
+)
+
 func main() {
 	var cfg Config
 
-	// read configuration from environment variables
-	if err := cleanenv.ReadEnv(&cfg); err != nil {
+	// read the configuration from the defaults, config file, environment variables and flags
+	var err error
+	loader, err = config.Parse(&cfg, os.Args[0], os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitConfig)
+	}
+	if err := loader.Load(&cfg); err != nil {
+		fmt.Println(err)
+		os.Exit(exitConfig)
+	}
+	current = cfg
+	if loader.PrintDocs {
+		config.Docs(os.Stdout, &cfg)
+		os.Exit(exitOK)
+	}
+	if loader.PrintConfig {
+		config.Print(os.Stdout, &cfg)
+		os.Exit(exitOK)
+	}
+	if err := logger.Init(cfg.Log); err != nil {
+		fmt.Println(err)
+		os.Exit(exitConfig)
+	}
+	if err := tracing.Init(cfg.Tracing, version); err != nil {
+		fmt.Println(err)
+		os.Exit(exitConfig)
+	}
+
+	// start the sinks before the proxy, so no event received from Home Connect is missed
+	logger.Info("Starting the event sinks ...")
+	if err := sinks.Start(cfg.Sinks); err != nil {
+		fmt.Println(err)
+		os.Exit(exitConfig)
+	}
+
+	if err := presets.Init(cfg.Presets); err != nil {
 		fmt.Println(err)
-		os.Exit(2)
+		os.Exit(exitConfig)
 	}
 
-	logger.Info("Starting the Home Connect client proxy ...")
-	go proxy.Run(cfg.Server.Port, cfg.OAuth.ClientID, cfg.OAuth.ClientSecret, cfg.OAuth.ClientScopes)
+	if err := scenes.Init(cfg.Scenes); err != nil {
+		fmt.Println(err)
+		os.Exit(exitConfig)
+	}
 
-	logger.Info("Starting the MQTT publisher for received SSE events ...")
-	mqttpublisher.InitSSEClient(cfg.Server.Port)
+	if err := rules.Init(cfg.Rules); err != nil {
+		fmt.Println(err)
+		os.Exit(exitConfig)
+	}
 
-	mqttpublisher.InitMqttPublisher(cfg.MQTT.Host, cfg.MQTT.Port, cfg.MQTT.Topic)
+	if err := scheduler.Init(cfg.Scheduler); err != nil {
+		fmt.Println(err)
+		os.Exit(exitConfig)
+	}
 
-	exitLoop := false
-	for !exitLoop {
-		runPublisher(&exitLoop)
+	registerDiagnostics()
+	proxy.HandleFunc("/proxy/config/reload", reloadHandler, "POST")
+
+	logger.Info("Starting the Home Connect client proxy {version} ...", "version", version)
+	proxy.Configure(cfg.Proxy)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- proxy.Run(cfg.Server.Port, cfg.OAuth.ClientID, cfg.OAuth.ClientSecret, cfg.OAuth.ClientScopes)
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	code := exitOK
+	running := true
+	for running {
+		select {
+		case <-hangups:
+			logger.Info("Received SIGHUP, reloading the configuration ...")
+			reloadAndLog()
+		case err := <-failed:
+			logger.Error("Proxy server failed: {err}", "err", err)
+			code = exitFailure
+			running = false
+		case sig := <-signals:
+			logger.Info("Received {signal}, shutting down ...", "signal", sig)
+			running = false
+		}
 	}
+	signal.Stop(hangups)
+
+	// a second signal ends the application without waiting for the shutdown
+	go func() {
+		sig := <-signals
+		logger.Error("Received {signal} during shutdown, exiting", "signal", sig)
+		os.Exit(exitFailure)
+	}()
+
+	if err := shutdown(cfg.Server.ShutdownTimeout); err != nil && code == exitOK {
+		code = exitFailure
+	}
+	os.Exit(code)
 }
 
-func runPublisher(exit *bool) {
-	events := make(chan mqttpublisher.Event)
-	go mqttpublisher.Notify(events)
-	for evnt := range events {
-		switch evnt.Action {
-		case "reconnect":
-			logger.Info("Reconnect SSE: '{r}'", "r", evnt.Message)
-			return
-		case "error":
-			logger.Error("Error in SSE client: '{e}'", "e", evnt.Message)
-			*exit = true
-			return
-		default:
-			logger.Info("Event received by MQTT publisher")
-			go mqttpublisher.Publish(evnt)
+// shutdown stops the subsystems in reverse order of their start: no more jobs are scheduled, the proxy
+// completes the requests in progress, the sinks deliver the queued events, and the pending spans are
+// exported. Returns the first error, e.g. if the timeout expired.
+func shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var first error
+	step := func(name string, stop func(ctx context.Context) error) {
+		if err := stop(ctx); err != nil {
+			logger.Error("Error stopping {name}: {err}", "name", name, "err", err.Error())
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	step("the scheduler", scheduler.Stop)
+	step("the proxy", proxy.Shutdown)
+	step("the event sinks", func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			sinks.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			return errors.New("event sinks did not stop in time")
 		}
+	})
+	step("the tracing", tracing.Shutdown)
+
+	if first == nil {
+		logger.Info("Shutdown completed")
 	}
+	logger.Close()
+	return first
+}
+
+// registerDiagnostics adds the sinks to the readiness checks, and the sinks and the
+// configuration in effect to the diagnostics of the proxy
+func registerDiagnostics() {
+	proxy.Version = version
+	proxy.RegisterCheck("sinks", func() error {
+		var failed []string
+		for name, err := range sinks.Health() {
+			if err != nil {
+				failed = append(failed, name+": "+err.Error())
+			}
+		}
+		if len(failed) > 0 {
+			sort.Strings(failed)
+			return errors.New(strings.Join(failed, "; "))
+		}
+		return nil
+	})
+	proxy.RegisterDiagnostics("sinks", func() interface{} {
+		health := map[string]string{}
+		for name, err := range sinks.Health() {
+			health[name] = "ok"
+			if err != nil {
+				health[name] = logger.Redact(err.Error())
+			}
+		}
+		return health
+	})
+	proxy.RegisterDiagnostics("config", func() interface{} {
+		cfg := effective()
+		if err := config.Redact(&cfg); err != nil {
+			return err.Error()
+		}
+		redacted, err := logger.RedactFields(cfg)
+		if err != nil {
+			return err.Error()
+		}
+		return redacted
+	})
 }
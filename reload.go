@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/ananchev/homeconnect-proxy/internal/config"
+	"github.com/ananchev/homeconnect-proxy/internal/logger"
+	"github.com/ananchev/homeconnect-proxy/internal/presets"
+	"github.com/ananchev/homeconnect-proxy/internal/proxy"
+	"github.com/ananchev/homeconnect-proxy/internal/rules"
+	"github.com/ananchev/homeconnect-proxy/internal/sinks"
+)
+
+// Report lists the changed keys of a reload
+type Report struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+var (
+	reloadMu sync.Mutex
+	loader   *config.Loader
+	// the configuration in effect: as loaded on start, with the reloaded keys applied
+	current Config
+)
+
+// effective returns the configuration in effect
+func effective() Config {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	return current
+}
+
+// reload reads the configuration again from its sources and applies the changes of reloadable keys.
+// Everything is validated first, so a new configuration is either applied as a whole or not at all.
+// Changes of other keys, and of the settings of sinks not running, are reported as requiring a restart.
+func reload() (Report, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	var cfg Config
+	if err := loader.Load(&cfg); err != nil {
+		return Report{}, err
+	}
+	changed, err := config.Changed(&current, &cfg)
+	if err != nil {
+		return Report{}, err
+	}
+
+	// prepare: read and validate, without changing anything yet
+	level, err := logger.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return Report{}, err
+	}
+	applyPresets, err := presets.Reconfigure(cfg.Presets)
+	if err != nil {
+		return Report{}, err
+	}
+	applyRules, err := rules.Reconfigure(cfg.Rules)
+	if err != nil {
+		return Report{}, err
+	}
+	applySinks, idle, err := sinks.Reconfigure(cfg.Sinks)
+	if err != nil {
+		return Report{}, err
+	}
+
+	fields, err := config.Fields(&cfg)
+	if err != nil {
+		return Report{}, err
+	}
+	reloadable := map[string]bool{}
+	for _, f := range fields {
+		reloadable[f.Key] = f.Reloadable
+	}
+	for _, key := range idle {
+		reloadable[key] = false
+	}
+	report := Report{Applied: []string{}, RestartRequired: []string{}}
+	for _, key := range changed {
+		if reloadable[key] {
+			report.Applied = append(report.Applied, key)
+		} else {
+			report.RestartRequired = append(report.RestartRequired, key)
+		}
+	}
+
+	// apply, keeping a level set at runtime through '/proxy/log/level' unless LOG_LEVEL changed
+	if cfg.Log.Level != current.Log.Level {
+		logger.SetLevel(level)
+	}
+	applyPresets()
+	applyRules()
+	proxy.Reconfigure(cfg.Proxy)()
+	applySinks()
+
+	if err := config.Copy(&current, &cfg, report.Applied); err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
+
+// reloadAndLog reloads the configuration and logs the outcome
+func reloadAndLog() (Report, error) {
+	report, err := reload()
+	if err != nil {
+		logger.Error("Configuration not reloaded: {err}", "err", err.Error())
+		return report, err
+	}
+	logger.Info("Configuration reloaded, applied: {applied}, restart required: {restart}", "applied", report.Applied, "restart", report.RestartRequired)
+	return report, nil
+}
+
+// Reload the configuration upon POST to '/proxy/config/reload'. Nothing is changed if the configuration is invalid.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := reloadAndLog()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}